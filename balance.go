@@ -4,25 +4,21 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
-	"strconv"
+	"time"
 
 	"gorm.io/gorm"
 )
 
-type CoinbasePrice struct {
-	Base     string
-	Currency string
-	Amount   string
-}
-
-type CoinbaseResponse struct {
-	Data CoinbasePrice
-}
-
 type Balance struct {
-	BTC                   float64
-	BTC_current_USD_value float64
-	USD                   float64
+	BTC float64
+	// null if no Bitcoin price in USD is available
+	BTC_current_USD_value *float64
+	// the source of the Bitcoin price in USD used for the valuation and the time of its observation
+	BTC_USD_price_source      string
+	BTC_USD_price_observed_at *time.Time
+	// whether the Bitcoin price in USD used for the valuation is a last known one
+	BTC_USD_price_stale bool
+	USD                 float64
 }
 
 type BalanceUpdate struct {
@@ -30,42 +26,33 @@ type BalanceUpdate struct {
 	Currency    string
 }
 
-func getBitcoinUSDPrice() (float64, error) {
-	response, err := http.Get("https://api.coinbase.com/v2/prices/spot?currency=USD")
-	if err != nil {
-		log.Printf("Unable to get Bitcoin price in USD. Error: %v", err)
-		return 0, err
-	}
-	defer response.Body.Close()
-	var responseData CoinbaseResponse
-	decoder := json.NewDecoder(response.Body)
-	decoder.DisallowUnknownFields()
-	err = decoder.Decode(&responseData)
-	if err != nil {
-		log.Printf("Unable to decode CoinbaseResponse from JSON. Error: %v", err)
-		return 0, err
-	}
-	value, err := strconv.ParseFloat(responseData.Data.Amount, 64)
-	if err != nil {
-		log.Printf("Unable to convert provided string to float64. Error: %v", err)
-		return 0, err
-	}
-	return value, nil
-}
-
 func getBalanceHandler(user *User, w http.ResponseWriter, r *http.Request) {
-	bitcoinUsdPrice, err := getBitcoinUSDPrice()
-	if err != nil {
-		log.Printf("Unable to get Bitcoin USD price. Error: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
+	valuation := r.URL.Query().Get("valuation")
+	if valuation == "" {
+		valuation = DEFAULT_VALUATION
+	}
+	oracle, found := VALUATION_ORACLES[valuation]
+	if !found {
+		log.Printf("Unknown valuation %v has been requested.", valuation)
+		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 	btcBalance := float64(user.BTCSatoshiBalance) / 100000000
 	usdBalance := float64(user.USDCentsBalance) / 100
 	balance := Balance{
-		BTC:                   btcBalance,
-		BTC_current_USD_value: btcBalance * bitcoinUsdPrice,
-		USD:                   usdBalance,
+		BTC: btcBalance,
+		USD: usdBalance,
+	}
+	quote, err := oracle.GetBitcoinUSDPrice()
+	if err != nil {
+		// the balance is still useful without its valuation
+		log.Printf("Unable to get Bitcoin USD price. Error: %v", err)
+	} else {
+		btcUsdValue := btcBalance * quote.Price
+		balance.BTC_current_USD_value = &btcUsdValue
+		balance.BTC_USD_price_source = quote.Source
+		balance.BTC_USD_price_observed_at = &quote.ObservedAt
+		balance.BTC_USD_price_stale = quote.Stale
 	}
 	log.Printf("Balance of user %v: %v", user.ID, balance)
 	output, err := json.Marshal(balance)
@@ -96,11 +83,28 @@ func postBalanceHandler(tx *gorm.DB, user *User, w http.ResponseWriter, r *http.
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	if balanceUpdate.TopupAmount <= 0 {
+		tx.Rollback()
+		// the withdrawals need to check the available balance and are therefore handled separately
+		log.Printf("Non-positive topup amount %v has been provided.", balanceUpdate.TopupAmount)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var amount int64
 	if balanceUpdate.Currency == "USD" {
-		user.USDCentsBalance += int64(balanceUpdate.TopupAmount * 100)
+		amount = int64(balanceUpdate.TopupAmount * 100)
+		user.USDCentsBalance += amount
 	}
 	if balanceUpdate.Currency == "BTC" {
-		user.BTCSatoshiBalance += int64(balanceUpdate.TopupAmount * 100000000)
+		amount = int64(balanceUpdate.TopupAmount * 100000000)
+		user.BTCSatoshiBalance += amount
+	}
+	_, err = postJournal(tx, "DEPOSIT", 0, transferEntries(EXTERNAL_ACCOUNT, user.ID, balanceUpdate.Currency, amount))
+	if err != nil {
+		tx.Rollback()
+		log.Printf("Unable to record the balance update in the ledger. Error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
 	result := tx.Save(user)
 	if result.Error != nil {
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+// The open, high, low and close prices and the traded volume
+// of the trades made within a single time interval.
+type Candle struct {
+	// the start of the interval
+	Time time.Time
+	// USD prices for one BTC
+	Open  float64
+	High  float64
+	Low   float64
+	Close float64
+	// traded quantity in BTC
+	Volume float64
+}
+
+// The summary of the current state of the market.
+// The prices are in USD for one BTC and the volume is in BTC.
+// The prices that are not available are null.
+type Ticker struct {
+	LastPrice *float64 `json:"last_price"`
+	BestBid   *float64 `json:"best_bid"`
+	BestAsk   *float64 `json:"best_ask"`
+	High24h   *float64 `json:"high_24h"`
+	Low24h    *float64 `json:"low_24h"`
+	Volume24h float64  `json:"volume_24h"`
+}
+
+var CANDLE_INTERVALS = map[string]time.Duration{
+	"1m": time.Minute,
+	"5m": 5 * time.Minute,
+	"1h": time.Hour,
+	"1d": 24 * time.Hour,
+}
+
+// The maximum number of intervals that can be requested at once.
+const MAX_CANDLES = 1000
+
+const DEFAULT_CANDLES = 100
+
+// Get the candles of the provided interval from the trades made in the provided time range.
+// The intervals without any trades are omitted.
+func getCandles(interval time.Duration, from time.Time, to time.Time) ([]*Candle, error) {
+	// the intervals are aligned to the Unix epoch, which means to midnight UTC for the days
+	seconds := int64(interval / time.Second)
+	var summaries []struct {
+		Bucket   int64
+		Open     float64
+		High     float64
+		Low      float64
+		Close    float64
+		Quantity int64
+	}
+	result := DB.Model(&Trade{}).Select(`floor(extract(epoch from created_at) / ?)::bigint as bucket,
+		(array_agg(price order by created_at asc, id asc))[1] as open, max(price) as high, min(price) as low,
+		(array_agg(price order by created_at desc, id desc))[1] as close, sum(quantity) as quantity`, seconds).Where("created_at >= ? AND created_at < ?", from, to).Group("bucket").Order("bucket asc").Scan(&summaries)
+	if err := result.Error; err != nil {
+		log.Printf("Unable to summarize the trades from %v to %v. Error: %v", from, to, err)
+		return nil, err
+	}
+	candles := []*Candle{}
+	for _, summary := range summaries {
+		candles = append(candles, &Candle{
+			Time:   time.Unix(summary.Bucket*seconds, 0).UTC(),
+			Open:   summary.Open * 1000000,
+			High:   summary.High * 1000000,
+			Low:    summary.Low * 1000000,
+			Close:  summary.Close * 1000000,
+			Volume: float64(summary.Quantity) / 100000000,
+		})
+	}
+	return candles, nil
+}
+
+// Get the time range of the candles from the URL query parameters.
+// By default, the range ends now and covers the default number of intervals.
+func getCandleRangeFromRequest(r *http.Request, interval time.Duration) (from time.Time, to time.Time, err error) {
+	query := r.URL.Query()
+	to = time.Now()
+	if value := query.Get("to"); value != "" {
+		to, err = time.Parse(time.RFC3339, value)
+		if err != nil {
+			log.Printf("Unable to parse the provided time. Error: %v", err)
+			return from, to, err
+		}
+	}
+	from = to.Add(-DEFAULT_CANDLES * interval)
+	if value := query.Get("from"); value != "" {
+		from, err = time.Parse(time.RFC3339, value)
+		if err != nil {
+			log.Printf("Unable to parse the provided time. Error: %v", err)
+			return from, to, err
+		}
+	}
+	if !from.Before(to) {
+		return from, to, errors.New("The start of the time range must be before its end.")
+	}
+	if to.Sub(from) > MAX_CANDLES*interval {
+		return from, to, errors.New("The time range covers too many intervals.")
+	}
+	return from, to, nil
+}
+
+func getCandlesHandler(w http.ResponseWriter, r *http.Request) {
+	intervalName := r.URL.Query().Get("interval")
+	interval, found := CANDLE_INTERVALS[intervalName]
+	if !found {
+		log.Printf("Unknown candle interval %v has been provided.", intervalName)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	from, to, err := getCandleRangeFromRequest(r, interval)
+	if err != nil {
+		log.Printf("Unable to get the time range. Error: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	candles, err := getCandles(interval, from, to)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	output, err := json.Marshal(candles)
+	if err != nil {
+		log.Printf("Unable to serialize Candle objects to JSON. Error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Write(output)
+}
+
+// The candles are public, so no authentication is required.
+func candlesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		getCandlesHandler(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func getTicker() (*Ticker, error) {
+	ticker := &Ticker{}
+	lastTrade, err := getLastTrade(DB)
+	if err != nil && !errors.Is(err, NO_PRICE_AVAILABLE) {
+		return nil, err
+	}
+	if lastTrade != nil {
+		lastPrice := lastTrade.Price * 1000000
+		ticker.LastPrice = &lastPrice
+	}
+	bidPrice, askPrice := ORDER_BOOK.BestPrices()
+	if bidPrice != 0 {
+		bestBid := bidPrice * 1000000
+		ticker.BestBid = &bestBid
+	}
+	if askPrice != 0 {
+		bestAsk := askPrice * 1000000
+		ticker.BestAsk = &bestAsk
+	}
+	var summary struct {
+		High     *float64
+		Low      *float64
+		Quantity int64
+	}
+	result := DB.Model(&Trade{}).Select("max(price) as high, min(price) as low, coalesce(sum(quantity), 0) as quantity").Where("created_at >= ?", time.Now().Add(-24*time.Hour)).Scan(&summary)
+	if err := result.Error; err != nil {
+		log.Printf("Unable to summarize the trades of the last 24 hours. Error: %v", err)
+		return nil, err
+	}
+	if summary.High != nil {
+		high := *summary.High * 1000000
+		ticker.High24h = &high
+	}
+	if summary.Low != nil {
+		low := *summary.Low * 1000000
+		ticker.Low24h = &low
+	}
+	ticker.Volume24h = float64(summary.Quantity) / 100000000
+	return ticker, nil
+}
+
+func getTickerHandler(w http.ResponseWriter, r *http.Request) {
+	ticker, err := getTicker()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	output, err := json.Marshal(ticker)
+	if err != nil {
+		log.Printf("Unable to serialize Ticker object to JSON. Error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Write(output)
+}
+
+// The ticker is public, so no authentication is required.
+func tickerHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		getTickerHandler(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
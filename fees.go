@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// The fees charged on every trade to the users whose trailing 30-day volume
+// is at least the minimum volume of the tier.
+// The fees are in basis points (hundredths of a percent)
+// of the amount received by the party which pays the fee.
+// The buyer pays the fee in Satoshis and the seller in USD cents,
+// so that the balances blocked by the live standing orders always suffice.
+type FeeTier struct {
+	// minimum trailing 30-day volume in USD
+	MinVolume   float64 `json:"min_volume"`
+	MakerFeeBps int64   `json:"maker_fee_bps"`
+	TakerFeeBps int64   `json:"taker_fee_bps"`
+}
+
+// The user's USD cents volume of the trades of the last 30 days,
+// as of the last recomputation.
+type FeeVolume struct {
+	UserId    string    `gorm:"primaryKey"`
+	Volume30d int64     `json:"volume_30d" gorm:"not null"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// The user's current fee tier and rates.
+type FeeSchedule struct {
+	// trailing 30-day volume in USD
+	Volume30d float64 `json:"volume_30d"`
+	// the index of the user's tier within the tiers
+	Tier        int
+	MakerFeeBps int64 `json:"maker_fee_bps"`
+	TakerFeeBps int64 `json:"taker_fee_bps"`
+	Tiers       []*FeeTier
+}
+
+const FEE_VOLUME_PERIOD = 30 * 24 * time.Hour
+
+// The time of the day in UTC at which the 30-day volumes are recomputed every night.
+const FEE_VOLUME_RECOMPUTE_TIME = 0 * time.Hour
+
+// The fee tiers sorted by their minimum volume, the first one starting at zero.
+var FEE_TIERS []*FeeTier
+
+// ID of the user to whom the fees are credited.
+var HOUSE_USER_ID string
+
+// Get the fee tiers from the provided JSON file,
+// or a single tier with the provided fees if no file is provided.
+func loadFeeTiers(path string, makerFeeBps int64, takerFeeBps int64) ([]*FeeTier, error) {
+	if path == "" {
+		return []*FeeTier{{MinVolume: 0, MakerFeeBps: makerFeeBps, TakerFeeBps: takerFeeBps}}, nil
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Printf("Unable to read the fee tiers from %v. Error: %v", path, err)
+		return nil, err
+	}
+	var feeTiers []*FeeTier
+	err = json.Unmarshal(content, &feeTiers)
+	if err != nil {
+		log.Printf("Unable to decode the fee tiers from JSON. Error: %v", err)
+		return nil, err
+	}
+	if len(feeTiers) == 0 || feeTiers[0].MinVolume != 0 {
+		return nil, errors.New("The minimum volume of the first fee tier needs to be zero.")
+	}
+	for i, feeTier := range feeTiers {
+		if i > 0 && feeTier.MinVolume <= feeTiers[i-1].MinVolume {
+			return nil, fmt.Errorf("The minimum volume %v of fee tier %v is not higher than the one of the previous tier.", feeTier.MinVolume, i)
+		}
+		if feeTier.MakerFeeBps < 0 || feeTier.MakerFeeBps >= 10000 || feeTier.TakerFeeBps < 0 || feeTier.TakerFeeBps >= 10000 {
+			return nil, fmt.Errorf("The fees of fee tier %v are out of the allowed range from 0 to 9999 basis points.", i)
+		}
+	}
+	return feeTiers, nil
+}
+
+// Whether any of the fee tiers charges a nonzero fee.
+func chargesFees() bool {
+	for _, feeTier := range FEE_TIERS {
+		if feeTier.MakerFeeBps > 0 || feeTier.TakerFeeBps > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the user's trailing 30-day USD cents volume as of the last recomputation.
+func getVolume30d(tx *gorm.DB, userId string) (int64, error) {
+	feeVolume := &FeeVolume{}
+	result := tx.Where(&FeeVolume{UserId: userId}).Take(feeVolume)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		// no trades in the last 30 days
+		return 0, nil
+	}
+	if err := result.Error; err != nil {
+		log.Printf("Unable to get the 30-day volume of user with ID %v. Error: %v", userId, err)
+		return 0, err
+	}
+	return feeVolume.Volume30d, nil
+}
+
+// Get the index of the fee tier which applies to the provided USD cents volume.
+func getFeeTierIndex(volume int64) int {
+	index := 0
+	for i, feeTier := range FEE_TIERS {
+		if float64(volume)/100 >= feeTier.MinVolume {
+			index = i
+		}
+	}
+	return index
+}
+
+// Get the fee rate in basis points of the user acting as the maker or the taker of a trade.
+func getFeeBps(tx *gorm.DB, userId string, maker bool) (int64, error) {
+	if !chargesFees() {
+		return 0, nil
+	}
+	volume, err := getVolume30d(tx, userId)
+	if err != nil {
+		return 0, err
+	}
+	feeTier := FEE_TIERS[getFeeTierIndex(volume)]
+	if maker {
+		return feeTier.MakerFeeBps, nil
+	}
+	return feeTier.TakerFeeBps, nil
+}
+
+// Get the fee on the provided amount (in USD cents or Satoshis) at the provided rate in basis points.
+// The fee is rounded down in favour of the user.
+func computeFee(amount int64, feeBps int64) int64 {
+	return int64(float64(amount) * float64(feeBps) / 10000)
+}
+
+// Credit the provided fees to the house user within the provided transaction.
+// If the house user is one of the provided parties to the trade,
+// the fees are credited to the provided object instead,
+// which the caller is expected to save.
+func creditFees(tx *gorm.DB, usdCentsFee int64, satoshiFee int64, parties ...*User) error {
+	if usdCentsFee == 0 && satoshiFee == 0 {
+		return nil
+	}
+	for _, party := range parties {
+		if party.ID == HOUSE_USER_ID {
+			party.USDCentsBalance += usdCentsFee
+			party.BTCSatoshiBalance += satoshiFee
+			return nil
+		}
+	}
+	result := tx.Model(&User{ID: HOUSE_USER_ID}).UpdateColumns(map[string]interface{}{
+		"usd_cents_balance":   gorm.Expr("usd_cents_balance + ?", usdCentsFee),
+		"btc_satoshi_balance": gorm.Expr("btc_satoshi_balance + ?", satoshiFee),
+	})
+	if err := result.Error; err != nil {
+		log.Printf("Unable to credit the fees of %v USD cents and %v Satoshis to the house user with ID %v. Error: %v", usdCentsFee, satoshiFee, HOUSE_USER_ID, err)
+		return err
+	}
+	return nil
+}
+
+// Recompute the trailing 30-day volumes of all users from their trades,
+// counting both the trades in which they are the maker and the ones in which they are the taker.
+func recomputeFeeVolumes() error {
+	tx := DB.Begin()
+	since := time.Now().Add(-FEE_VOLUME_PERIOD)
+	var feeVolumes []*FeeVolume
+	result := tx.Raw(`SELECT user_id, SUM(usd_cents_amount) AS volume30d FROM (
+		SELECT maker_user_id AS user_id, usd_cents_amount FROM trades WHERE created_at >= ?
+		UNION ALL
+		SELECT taker_user_id AS user_id, usd_cents_amount FROM trades WHERE created_at >= ?
+	) AS fills GROUP BY user_id`, since, since).Scan(&feeVolumes)
+	if err := result.Error; err != nil {
+		tx.Rollback()
+		log.Printf("Unable to compute the 30-day volumes. Error: %v", err)
+		return err
+	}
+	// the users without trades in the last 30 days are left without a volume
+	result = tx.Where("1 = 1").Delete(&FeeVolume{})
+	if err := result.Error; err != nil {
+		tx.Rollback()
+		log.Printf("Unable to delete the previous 30-day volumes. Error: %v", err)
+		return err
+	}
+	if len(feeVolumes) > 0 {
+		result = tx.Create(&feeVolumes)
+		if err := result.Error; err != nil {
+			tx.Rollback()
+			log.Printf("Unable to save the 30-day volumes. Error: %v", err)
+			return err
+		}
+	}
+	result = tx.Commit()
+	if err := result.Error; err != nil {
+		tx.Rollback()
+		log.Printf("Unable to commit the transaction. Error: %v", result.Error)
+		return err
+	}
+	log.Printf("Recomputed the 30-day volumes of %v users.", len(feeVolumes))
+	return nil
+}
+
+// Get the time of the first nightly recomputation of the 30-day volumes after the provided time.
+func getNextFeeVolumeRecomputeTime(now time.Time) time.Time {
+	// the truncation is aligned to midnight UTC
+	next := now.UTC().Truncate(24 * time.Hour).Add(FEE_VOLUME_RECOMPUTE_TIME)
+	if !next.After(now) {
+		next = next.Add(24 * time.Hour)
+	}
+	return next
+}
+
+// Keep recomputing the 30-day volumes in the background every night,
+// starting immediately because the volumes might have become stale while the exchange was down.
+func startFeeVolumeRecomputer() {
+	log.Printf("Starting the 30-day volume recomputer.")
+	go func() {
+		for {
+			recomputeFeeVolumes()
+			time.Sleep(time.Until(getNextFeeVolumeRecomputeTime(time.Now())))
+		}
+	}()
+}
+
+// Get the user's current fee tier and rates.
+func (user *User) GetFeeSchedule() (*FeeSchedule, error) {
+	volume, err := getVolume30d(DB, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	index := getFeeTierIndex(volume)
+	return &FeeSchedule{
+		Volume30d:   float64(volume) / 100,
+		Tier:        index,
+		MakerFeeBps: FEE_TIERS[index].MakerFeeBps,
+		TakerFeeBps: FEE_TIERS[index].TakerFeeBps,
+		Tiers:       FEE_TIERS,
+	}, nil
+}
+
+func getFeesHandler(user *User, w http.ResponseWriter, r *http.Request) {
+	feeSchedule, err := user.GetFeeSchedule()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	output, err := json.Marshal(feeSchedule)
+	if err != nil {
+		log.Printf("Unable to serialize FeeSchedule object to JSON. Error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Write(output)
+}
+
+func feesHandler(w http.ResponseWriter, r *http.Request) {
+	tx := DB.Begin()
+	user := getAuthenticatedUser(tx, r)
+	if user == nil {
+		tx.Rollback()
+		log.Printf("Unable to get authenticated user.")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		tx.Rollback() // DB transaction is unnecessary in this case
+		getFeesHandler(user, w, r)
+	default:
+		tx.Rollback()
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
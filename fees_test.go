@@ -0,0 +1,118 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestComputeFee(t *testing.T) {
+	tests := []struct {
+		amount int64
+		feeBps int64
+		fee    int64
+	}{
+		{100000, 0, 0},
+		{100000, 10, 100},
+		{100000, 25, 250},
+		{100000, 9999, 99990},
+		// rounded down in favour of the user
+		{999, 10, 0},
+		{1999, 10, 1},
+		{0, 10, 0},
+	}
+	for _, test := range tests {
+		fee := computeFee(test.amount, test.feeBps)
+		if fee != test.fee {
+			t.Errorf("The fee on %v at %v basis points is %v, expected %v.", test.amount, test.feeBps, fee, test.fee)
+		}
+	}
+}
+
+func TestGetFeeTierIndex(t *testing.T) {
+	feeTiers := FEE_TIERS
+	defer func() { FEE_TIERS = feeTiers }()
+	FEE_TIERS = []*FeeTier{
+		{MinVolume: 0, MakerFeeBps: 10, TakerFeeBps: 20},
+		{MinVolume: 1000, MakerFeeBps: 5, TakerFeeBps: 10},
+		{MinVolume: 100000, MakerFeeBps: 0, TakerFeeBps: 5},
+	}
+	tests := []struct {
+		// in USD cents
+		volume int64
+		index  int
+	}{
+		{0, 0},
+		{99999, 0},
+		{100000, 1},
+		{9999999, 1},
+		{10000000, 2},
+		{1000000000, 2},
+	}
+	for _, test := range tests {
+		index := getFeeTierIndex(test.volume)
+		if index != test.index {
+			t.Errorf("The fee tier of the volume of %v USD cents is %v, expected %v.", test.volume, index, test.index)
+		}
+	}
+}
+
+func TestLoadFeeTiers(t *testing.T) {
+	tests := []struct {
+		content string
+		tiers   int
+		valid   bool
+	}{
+		{`[{"min_volume": 0, "maker_fee_bps": 10, "taker_fee_bps": 20}]`, 1, true},
+		{`[{"min_volume": 0, "maker_fee_bps": 10, "taker_fee_bps": 20}, {"min_volume": 1000, "maker_fee_bps": 5, "taker_fee_bps": 10}]`, 2, true},
+		{`[]`, 0, false},
+		// the first tier needs to start at zero
+		{`[{"min_volume": 1000, "maker_fee_bps": 10, "taker_fee_bps": 20}]`, 0, false},
+		// the minimum volumes need to increase
+		{`[{"min_volume": 0, "maker_fee_bps": 10, "taker_fee_bps": 20}, {"min_volume": 0, "maker_fee_bps": 5, "taker_fee_bps": 10}]`, 0, false},
+		{`[{"min_volume": 0, "maker_fee_bps": 10000, "taker_fee_bps": 20}]`, 0, false},
+		{`[{"min_volume": 0, "maker_fee_bps": 10, "taker_fee_bps": -1}]`, 0, false},
+		{`{"min_volume": 0}`, 0, false},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "fee_tiers.json")
+		err := ioutil.WriteFile(path, []byte(test.content), 0600)
+		if err != nil {
+			t.Fatalf("Unable to write the fee tiers. Error: %v", err)
+		}
+		feeTiers, err := loadFeeTiers(path, 0, 0)
+		if (err == nil) != test.valid {
+			t.Errorf("The fee tiers %v have been loaded with error %v, expected them to be valid: %v.", test.content, err, test.valid)
+		}
+		if len(feeTiers) != test.tiers {
+			t.Errorf("The fee tiers %v have been loaded as %v tiers, expected %v.", test.content, len(feeTiers), test.tiers)
+		}
+	}
+	// a single tier with the provided fees if no file is provided
+	feeTiers, err := loadFeeTiers("", 10, 20)
+	if err != nil || len(feeTiers) != 1 || feeTiers[0].MakerFeeBps != 10 || feeTiers[0].TakerFeeBps != 20 {
+		t.Errorf("The default fee tiers are %v with error %v, expected a single tier with 10 and 20 basis points.", feeTiers, err)
+	}
+}
+
+func TestGetNextFeeVolumeRecomputeTime(t *testing.T) {
+	midnight := time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		now  time.Time
+		next time.Time
+	}{
+		{midnight.Add(-time.Nanosecond), midnight},
+		// the recomputation which is due right now has already been started
+		{midnight, midnight.Add(24 * time.Hour)},
+		{midnight.Add(13 * time.Hour), midnight.Add(24 * time.Hour)},
+		// the time of the day is in UTC regardless of the provided time zone
+		{midnight.Add(13 * time.Hour).In(time.FixedZone("UTC-11", -11*60*60)), midnight.Add(24 * time.Hour)},
+	}
+	for _, test := range tests {
+		next := getNextFeeVolumeRecomputeTime(test.now)
+		if !next.Equal(test.next) {
+			t.Errorf("The next recomputation after %v is at %v, expected %v.", test.now, next, test.next)
+		}
+	}
+}
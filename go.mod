@@ -3,6 +3,7 @@ module bitcoin-exchange
 go 1.15
 
 require (
+	github.com/gorilla/websocket v1.4.2
 	gorm.io/driver/postgres v1.0.8
 	gorm.io/gorm v1.20.12
 )
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"gorm.io/gorm"
+)
+
+// Get the quantity in Satoshis of the standing order which can be matched right now
+// and which is shown in the order book.
+// Only the visible part of an iceberg order can be matched.
+func (standingOrder *StandingOrder) GetMatchableQuantity() int64 {
+	if standingOrder.DisplayQuantity == 0 {
+		return standingOrder.RemainingQuantity
+	}
+	return standingOrder.VisibleQuantity
+}
+
+// Reduce the visible part of an iceberg order by the provided Satoshi amount matched against it.
+// Once the visible part is used up, it is replenished from the hidden remainder
+// and goes to the back of the queue at its limit price.
+func (standingOrder *StandingOrder) consumeVisibleQuantity(tx *gorm.DB, satoshiAmount int64) error {
+	if standingOrder.DisplayQuantity == 0 {
+		return nil
+	}
+	standingOrder.VisibleQuantity -= satoshiAmount
+	if standingOrder.VisibleQuantity > 0 || standingOrder.RemainingQuantity == 0 {
+		return nil
+	}
+	sequence, err := getNextStandingOrderSequence(tx)
+	if err != nil {
+		return err
+	}
+	standingOrder.Sequence = sequence
+	standingOrder.VisibleQuantity = standingOrder.DisplayQuantity
+	standingOrder.clampVisibleQuantity()
+	return nil
+}
+
+// Keep the visible part of an iceberg order within its remaining quantity.
+func (standingOrder *StandingOrder) clampVisibleQuantity() {
+	if standingOrder.VisibleQuantity > standingOrder.RemainingQuantity {
+		standingOrder.VisibleQuantity = standingOrder.RemainingQuantity
+	}
+}
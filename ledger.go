@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// The account which represents the world outside of the exchange.
+// It cannot clash with the IDs of the users
+// because those can only contain alphanumeric characters and underscores.
+const EXTERNAL_ACCOUNT = "@external"
+
+// A set of ledger entries which together record a single change of the balances.
+// The amounts of the entries in each currency always add up to zero.
+type Journal struct {
+	// Using signed integers in the models because the underlying database (PostgreSQL) only supports signed integers.
+	ID int64 `gorm:"primaryKey"`
+	// DEPOSIT, WITHDRAWAL, TRADE or FEE
+	Kind string `gorm:"not null"`
+	// ID of the trade which has caused the change or zero if there is no such trade
+	TradeId   int64     `json:"trade_id" gorm:"not null; index"`
+	CreatedAt time.Time `json:"created_at"`
+	Entries   []LedgerEntry
+}
+
+// A change of the balance of a single account in a single currency.
+type LedgerEntry struct {
+	ID        int64 `gorm:"primaryKey"`
+	JournalId int64 `json:"journal_id" gorm:"not null; index"`
+	// the ID of the user or EXTERNAL_ACCOUNT
+	Account string `gorm:"not null; index:idx_account"`
+	// USD or BTC
+	Currency string `gorm:"not null; index:idx_account"`
+	// Signed amount in USD cents or Satoshis, depending on the currency.
+	// Positive amounts increase the balance of the account.
+	Amount int64 `gorm:"not null"`
+	// the kind of the journal to which the entry belongs
+	Kind      string    `gorm:"not null"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Get the ledger entries which transfer the provided amount of the currency between the accounts.
+func transferEntries(fromAccount string, toAccount string, currency string, amount int64) []LedgerEntry {
+	return []LedgerEntry{
+		{Account: fromAccount, Currency: currency, Amount: -amount},
+		{Account: toAccount, Currency: currency, Amount: amount},
+	}
+}
+
+// Record a journal consisting of the provided ledger entries within the provided transaction.
+func postJournal(tx *gorm.DB, kind string, tradeId int64, entries []LedgerEntry) (*Journal, error) {
+	sums := map[string]int64{}
+	for i := range entries {
+		entries[i].Kind = kind
+		sums[entries[i].Currency] += entries[i].Amount
+	}
+	for currency, sum := range sums {
+		if sum != 0 {
+			return nil, fmt.Errorf("The ledger entries %v in %v are not balanced, their sum is %v.", entries, currency, sum)
+		}
+	}
+	journal := &Journal{
+		Kind:    kind,
+		TradeId: tradeId,
+		Entries: entries,
+	}
+	// the entries are created together with the journal
+	result := tx.Create(journal)
+	if err := result.Error; err != nil {
+		log.Printf("Unable to create journal %v. Error: %v", journal, err)
+		return nil, err
+	}
+	log.Printf("Journal posted: Type: %T, Value: %v", journal, journal)
+	return journal, nil
+}
+
+// Get the user's USD cents and Satoshi balances derived from the user's ledger entries.
+func (user *User) GetLedgerBalances(tx *gorm.DB) (usdCentsBalance int64, satoshiBalance int64, err error) {
+	var sums []struct {
+		Currency string
+		Sum      int64
+	}
+	result := tx.Model(&LedgerEntry{}).Select("currency, sum(amount) as sum").Where(&LedgerEntry{Account: user.ID}).Group("currency").Scan(&sums)
+	if err := result.Error; err != nil {
+		log.Printf("Unable to sum the ledger entries of user with ID %v. Error: %v", user.ID, err)
+		return 0, 0, err
+	}
+	for _, sum := range sums {
+		if sum.Currency == "USD" {
+			usdCentsBalance = sum.Sum
+		}
+		if sum.Currency == "BTC" {
+			satoshiBalance = sum.Sum
+		}
+	}
+	return usdCentsBalance, satoshiBalance, nil
+}
+
+// Post an opening DEPOSIT journal from the external account for the balances of every user
+// who does not have any ledger entries yet, i.e. whose balances predate the ledger.
+// The users who already have ledger entries are left alone,
+// so that it is safe to run it again.
+func seedLedger() (int, error) {
+	tx := DB.Begin()
+	var users []*User
+	result := tx.Where("NOT EXISTS (SELECT 1 FROM ledger_entries WHERE ledger_entries.account = users.id)").Where("usd_cents_balance <> 0 OR btc_satoshi_balance <> 0").Order("id asc").Find(&users)
+	if err := result.Error; err != nil {
+		tx.Rollback()
+		log.Printf("Unable to get the users without ledger entries. Error: %v", err)
+		return 0, err
+	}
+	for _, user := range users {
+		var entries []LedgerEntry
+		if user.USDCentsBalance != 0 {
+			entries = append(entries, transferEntries(EXTERNAL_ACCOUNT, user.ID, "USD", user.USDCentsBalance)...)
+		}
+		if user.BTCSatoshiBalance != 0 {
+			entries = append(entries, transferEntries(EXTERNAL_ACCOUNT, user.ID, "BTC", user.BTCSatoshiBalance)...)
+		}
+		_, err := postJournal(tx, "DEPOSIT", 0, entries)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+	result = tx.Commit()
+	if err := result.Error; err != nil {
+		tx.Rollback()
+		log.Printf("Unable to commit the transaction. Error: %v", result.Error)
+		return 0, err
+	}
+	log.Printf("Posted the opening balances of %v users to the ledger.", len(users))
+	return len(users), nil
+}
+
+// Check that the balances of all the users match their ledger entries.
+// Returns the number of users whose balances do not match.
+func verifyLedger() (int, error) {
+	var users []*User
+	result := DB.Order("id asc").Find(&users)
+	if err := result.Error; err != nil {
+		log.Printf("Unable to get the users. Error: %v", err)
+		return 0, err
+	}
+	mismatches := 0
+	for _, user := range users {
+		usdCentsBalance, satoshiBalance, err := user.GetLedgerBalances(DB)
+		if err != nil {
+			return 0, err
+		}
+		if usdCentsBalance != user.USDCentsBalance || satoshiBalance != user.BTCSatoshiBalance {
+			log.Printf("Balances of user with ID %v do not match the ledger: %v USD cents and %v Satoshis, but the ledger has %v USD cents and %v Satoshis.", user.ID, user.USDCentsBalance, user.BTCSatoshiBalance, usdCentsBalance, satoshiBalance)
+			mismatches++
+		}
+	}
+	log.Printf("Verified the balances of %v users against the ledger, %v of them do not match.", len(users), mismatches)
+	return mismatches, nil
+}
+
+// Get the user's ledger entries, starting with the most recent ones.
+func (user *User) GetLedgerEntries(offset int, limit int) ([]*LedgerEntry, error) {
+	entries := []*LedgerEntry{}
+	result := DB.Where(&LedgerEntry{Account: user.ID}).Order("id desc").Offset(offset).Limit(limit).Find(&entries)
+	if err := result.Error; err != nil {
+		log.Printf("Unable to get ledger entries of user with ID %v. Error: %v", user.ID, err)
+		return nil, err
+	}
+	return entries, nil
+}
+
+func getLedgerHandler(user *User, w http.ResponseWriter, r *http.Request) {
+	offset, limit, err := getPageFromRequest(r)
+	if err != nil {
+		log.Printf("Unable to get the requested page. Error: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	entries, err := user.GetLedgerEntries(offset, limit)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	output, err := json.Marshal(entries)
+	if err != nil {
+		log.Printf("Unable to serialize LedgerEntry objects to JSON. Error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Write(output)
+}
+
+func ledgerHandler(w http.ResponseWriter, r *http.Request) {
+	tx := DB.Begin()
+	user := getAuthenticatedUser(tx, r)
+	if user == nil {
+		tx.Rollback()
+		log.Printf("Unable to get authenticated user.")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		// DB transaction with the read operation on user is unnecessary in this case
+		tx.Rollback()
+		getLedgerHandler(user, w, r)
+	default:
+		tx.Rollback()
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -6,6 +6,8 @@
 // When a new order of any type arrives,
 // it fulfills the suitable existing standing orders
 // at their limit prices.
+// The live standing orders are kept in an in-memory order book,
+// which is rebuilt from the database on startup.
 package main
 
 import (
@@ -13,7 +15,9 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"regexp"
+	"time"
 
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
@@ -30,16 +34,46 @@ var DSN string = "host=localhost dbname=bitcoin_exchange default_transaction_iso
 
 var DB *gorm.DB
 
-func parseFlags() (init bool, port uint) {
-	flag.BoolVar(&init, "init", false, "Initialize the database.")
-	flag.UintVar(&port, "port", 8000, "Port on which to start the HTTP server.")
+// The command line configuration of the exchange.
+type Config struct {
+	Init             bool
+	VerifyLedger     bool
+	RecomputeVolumes bool
+	Port             uint
+	PriceSources     string
+	PriceTtl         time.Duration
+	Valuation        string
+	MakerFeeBps      int64
+	TakerFeeBps      int64
+	FeeTiers         string
+	HouseUserId      string
+}
+
+func parseFlags() *Config {
+	config := &Config{}
+	flag.BoolVar(&config.Init, "init", false, "Initialize the database.")
+	flag.BoolVar(&config.VerifyLedger, "verify_ledger", false, "Verify the balances of the users against the ledger.")
+	flag.BoolVar(&config.RecomputeVolumes, "recompute_volumes", false, "Recompute the trailing 30-day volumes of the users which determine their fee tiers.")
+	flag.UintVar(&config.Port, "port", 8000, "Port on which to start the HTTP server.")
+	flag.StringVar(&config.PriceSources, "price_sources", "coinbase", "Comma-separated list of the sources of the Bitcoin price in USD, in the order in which they are tried. Either \"coinbase\" or a path to a local file or an HTTP URL whose content is the price.")
+	flag.DurationVar(&config.PriceTtl, "price_ttl", 10*time.Second, "Time for which the Bitcoin price in USD is cached.")
+	flag.StringVar(&config.Valuation, "valuation", "oracle", "Default source of the Bitcoin price in USD used for the valuation of the balances. One of \"oracle\" (the price sources), \"last_trade\", \"best_bid\" or \"mid\".")
+	flag.Int64Var(&config.MakerFeeBps, "maker_fee_bps", 0, "Fee paid by the maker of every trade in basis points of the amount received.")
+	flag.Int64Var(&config.TakerFeeBps, "taker_fee_bps", 0, "Fee paid by the taker of every trade in basis points of the amount received.")
+	flag.StringVar(&config.FeeTiers, "fee_tiers", "", "Path to a JSON file with the list of the fee tiers by the trailing 30-day volume in USD, e.g. [{\"min_volume\": 0, \"maker_fee_bps\": 10, \"taker_fee_bps\": 20}, {\"min_volume\": 100000, \"maker_fee_bps\": 5, \"taker_fee_bps\": 10}]. Overrides the maker_fee_bps and taker_fee_bps flags.")
+	flag.StringVar(&config.HouseUserId, "house_user", "", "ID of the registered user to whom the fees are credited. Required if any fee is nonzero.")
 	flag.Parse()
-	return init, port
+	return config
 }
 
 func initDatabase() {
 	log.Printf("Initializing the database.")
-	DB.AutoMigrate(&User{}, &StandingOrder{})
+	DB.AutoMigrate(&User{}, &StandingOrder{}, &Trade{}, &Journal{}, &LedgerEntry{}, &Withdrawal{}, &WebhookEvent{}, &FeeVolume{})
+	// the balances which predate the ledger
+	_, err := seedLedger()
+	if err != nil {
+		log.Fatal("Unable to post the opening balances to the ledger.")
+	}
 	log.Printf("The database has been initialized.")
 }
 
@@ -48,22 +82,92 @@ func registerHandlers() {
 	http.HandleFunc("/register/", registerUserHandler)
 	http.HandleFunc("/balance", balanceHandler)
 	http.HandleFunc("/market_order", marketOrderHandler)
+	http.HandleFunc("/market_order/quote", marketOrderQuoteHandler)
 	http.HandleFunc("/standing_order", standingOrderHandler)
 	http.HandleFunc("/standing_order/", standingOrderHandler)
+	http.HandleFunc("/oco_order", ocoOrderHandler)
+	http.HandleFunc("/trades", tradesHandler)
+	http.HandleFunc("/ledger", ledgerHandler)
+	http.HandleFunc("/withdrawal", withdrawalHandler)
+	http.HandleFunc("/withdrawal/", withdrawalHandler)
+	http.HandleFunc("/webhook_secret", webhookSecretHandler)
+	http.HandleFunc("/market_data", marketDataHandler)
+	http.HandleFunc("/order_book", orderBookHandler)
+	http.HandleFunc("/candles", candlesHandler)
+	http.HandleFunc("/ticker", tickerHandler)
+	http.HandleFunc("/fees", feesHandler)
 	log.Printf("The HTTP handlers have been registered.")
 }
 
 func main() {
-	init, port := parseFlags()
+	config := parseFlags()
 	var err error
+	PRICE_ORACLE, err = newPriceOracle(config.PriceSources, config.PriceTtl)
+	if err != nil {
+		log.Fatalf("Unable to create the price oracle. Error: %v", err)
+	}
+	VALUATION_ORACLES = getValuationOracles(PRICE_ORACLE)
+	if _, found := VALUATION_ORACLES[config.Valuation]; !found {
+		log.Fatalf("Unknown valuation %v.", config.Valuation)
+	}
+	DEFAULT_VALUATION = config.Valuation
+	if config.MakerFeeBps < 0 || config.MakerFeeBps >= 10000 || config.TakerFeeBps < 0 || config.TakerFeeBps >= 10000 {
+		log.Fatalf("The fees of %v and %v basis points are out of the allowed range from 0 to 9999.", config.MakerFeeBps, config.TakerFeeBps)
+	}
+	FEE_TIERS, err = loadFeeTiers(config.FeeTiers, config.MakerFeeBps, config.TakerFeeBps)
+	if err != nil {
+		log.Fatalf("Unable to load the fee tiers. Error: %v", err)
+	}
+	HOUSE_USER_ID = config.HouseUserId
 	DB, err = gorm.Open(postgres.Open(DSN), &gorm.Config{})
 	if err != nil {
 		log.Fatal("Unable to connect to the database.")
 	}
-	if init {
+	if config.Init {
 		initDatabase()
 		return
 	}
+	if config.RecomputeVolumes {
+		err = recomputeFeeVolumes()
+		if err != nil {
+			log.Fatal("Unable to recompute the 30-day volumes.")
+		}
+		return
+	}
+	if config.VerifyLedger {
+		mismatches, err := verifyLedger()
+		if err != nil {
+			log.Fatal("Unable to verify the ledger.")
+		}
+		if mismatches > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+	if chargesFees() {
+		if HOUSE_USER_ID == "" {
+			log.Fatal("The house user to whom the fees are credited has not been provided.")
+		}
+		found, err := getUserFromDb(DB, &User{ID: HOUSE_USER_ID})
+		if err != nil {
+			log.Fatal("Unable to get the house user.")
+		}
+		if !found {
+			log.Fatalf("The house user with ID %v is not registered.", HOUSE_USER_ID)
+		}
+	}
+	err = cancelInterruptedImmediateOrders()
+	if err != nil {
+		log.Fatal("Unable to cancel the interrupted immediate standing orders.")
+	}
+	err = ORDER_BOOK.Load(DB)
+	if err != nil {
+		log.Fatal("Unable to load the order book.")
+	}
+	startWebhookDispatcher()
+	startExpirySweeper()
+	startStopOrderTrigger()
+	startFeeVolumeRecomputer()
 	registerHandlers()
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%v", port), nil))
+	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%v", config.Port), nil))
 }
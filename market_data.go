@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// A message sent to the clients of the market data feed.
+type MarketDataMessage struct {
+	// "subscribed", "unsubscribed", "update" or "error"
+	Type    string `json:"type"`
+	Channel string `json:"channel,omitempty"`
+	// The sequence number of the last update published on the channel.
+	// The updates on each channel are numbered consecutively,
+	// so a client can detect a gap by comparing it with the previous one.
+	Sequence int64       `json:"sequence,omitempty"`
+	Data     interface{} `json:"data,omitempty"`
+}
+
+// A message sent by a client of the market data feed.
+type MarketDataRequest struct {
+	// "subscribe" or "unsubscribe"
+	Type     string
+	Channels []string
+}
+
+// A trade as published on the "trades" channel.
+type PublicTrade struct {
+	ID int64
+	// the type of the taker order, BUY or SELL
+	Side string
+	// USD price for one BTC
+	Price float64
+	// quantity in BTC
+	Quantity  float64
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// The new state of a price level as published on the "order_book" channel.
+type OrderBookLevelUpdate struct {
+	// BUY for the bids, SELL for the asks
+	Side string
+	// USD price for one BTC
+	Price float64
+	// Total remaining quantity in BTC of the live standing orders at the price.
+	// Zero means that the price level has been removed.
+	Quantity   float64
+	OrderCount int `json:"order_count"`
+}
+
+// A snapshot of the order book, sent on subscription to the "order_book" channel
+// and returned by the order book depth endpoint.
+// The bids and asks are both sorted from the best price.
+type OrderBookSnapshot struct {
+	Bids []*OrderBookLevelUpdate
+	Asks []*OrderBookLevelUpdate
+}
+
+var MARKET_DATA_CHANNELS = map[string]bool{"trades": true, "order_book": true}
+
+// The number of messages that can wait to be sent to a single client.
+// The clients that do not keep up are disconnected.
+const MARKET_DATA_BUFFER_SIZE = 256
+
+type MarketDataSubscriber struct {
+	connection *websocket.Conn
+	channels   map[string]bool
+	outgoing   chan *MarketDataMessage
+}
+
+// Publishes the trades and the changes of the order book
+// to the subscribed clients.
+type MarketDataFeed struct {
+	mutex       sync.Mutex
+	sequences   map[string]int64
+	subscribers map[*MarketDataSubscriber]bool
+}
+
+var MARKET_DATA_FEED = &MarketDataFeed{
+	sequences:   map[string]int64{},
+	subscribers: map[*MarketDataSubscriber]bool{},
+}
+
+var MARKET_DATA_UPGRADER = websocket.Upgrader{
+	// the market data are public
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+func newPublicTrade(trade *Trade) *PublicTrade {
+	return &PublicTrade{
+		ID:        trade.ID,
+		Side:      trade.Side,
+		Price:     trade.Price * 1000000,
+		Quantity:  float64(trade.Quantity) / 100000000,
+		CreatedAt: trade.CreatedAt,
+	}
+}
+
+func newOrderBookLevelUpdate(orderType string, level *PriceLevel) *OrderBookLevelUpdate {
+	return &OrderBookLevelUpdate{
+		Side:       orderType,
+		Price:      level.Price * 1000000,
+		Quantity:   float64(level.Quantity()) / 100000000,
+		OrderCount: len(level.Orders),
+	}
+}
+
+// Send the provided message to the subscriber without waiting.
+// Must be called with the feed's mutex locked.
+func (feed *MarketDataFeed) send(subscriber *MarketDataSubscriber, message *MarketDataMessage) {
+	select {
+	case subscriber.outgoing <- message:
+	default:
+		log.Printf("Disconnecting the market data subscriber %v which does not keep up.", subscriber.connection.RemoteAddr())
+		delete(feed.subscribers, subscriber)
+		close(subscriber.outgoing)
+	}
+}
+
+// Publish the provided data as the next update on the channel.
+func (feed *MarketDataFeed) Publish(channel string, data interface{}) {
+	feed.mutex.Lock()
+	defer feed.mutex.Unlock()
+	feed.sequences[channel]++
+	message := &MarketDataMessage{
+		Type:     "update",
+		Channel:  channel,
+		Sequence: feed.sequences[channel],
+		Data:     data,
+	}
+	for subscriber := range feed.subscribers {
+		if subscriber.channels[channel] {
+			feed.send(subscriber, message)
+		}
+	}
+}
+
+// Handle the provided request of the subscriber.
+// The order book is locked for the duration of the subscription to the "order_book" channel
+// so that its snapshot and the sequence number are consistent.
+func (feed *MarketDataFeed) handleRequest(subscriber *MarketDataSubscriber, request *MarketDataRequest) {
+	if request.Type != "subscribe" && request.Type != "unsubscribe" {
+		feed.mutex.Lock()
+		feed.send(subscriber, &MarketDataMessage{Type: "error", Data: "Unknown request type " + request.Type + "."})
+		feed.mutex.Unlock()
+		return
+	}
+	// the order book is always locked before the feed to avoid deadlocks
+	ORDER_BOOK.Begin()
+	defer ORDER_BOOK.Commit()
+	feed.mutex.Lock()
+	defer feed.mutex.Unlock()
+	if !feed.subscribers[subscriber] {
+		// the subscriber has already been disconnected
+		return
+	}
+	for _, channel := range request.Channels {
+		if !MARKET_DATA_CHANNELS[channel] {
+			feed.send(subscriber, &MarketDataMessage{Type: "error", Channel: channel, Data: "Unknown channel."})
+			continue
+		}
+		message := &MarketDataMessage{Channel: channel, Sequence: feed.sequences[channel]}
+		if request.Type == "subscribe" {
+			subscriber.channels[channel] = true
+			message.Type = "subscribed"
+			if channel == "order_book" {
+				message.Data = ORDER_BOOK.snapshot(0)
+			}
+		} else {
+			delete(subscriber.channels, channel)
+			message.Type = "unsubscribed"
+		}
+		feed.send(subscriber, message)
+	}
+}
+
+func (feed *MarketDataFeed) addSubscriber(connection *websocket.Conn) *MarketDataSubscriber {
+	subscriber := &MarketDataSubscriber{
+		connection: connection,
+		channels:   map[string]bool{},
+		outgoing:   make(chan *MarketDataMessage, MARKET_DATA_BUFFER_SIZE),
+	}
+	feed.mutex.Lock()
+	feed.subscribers[subscriber] = true
+	feed.mutex.Unlock()
+	return subscriber
+}
+
+func (feed *MarketDataFeed) removeSubscriber(subscriber *MarketDataSubscriber) {
+	feed.mutex.Lock()
+	defer feed.mutex.Unlock()
+	if feed.subscribers[subscriber] {
+		delete(feed.subscribers, subscriber)
+		close(subscriber.outgoing)
+	}
+}
+
+// Write the messages for the subscriber to its connection until there are no more.
+func (subscriber *MarketDataSubscriber) writeMessages() {
+	for message := range subscriber.outgoing {
+		err := subscriber.connection.WriteJSON(message)
+		if err != nil {
+			log.Printf("Unable to write to the market data subscriber %v. Error: %v", subscriber.connection.RemoteAddr(), err)
+			break
+		}
+	}
+	subscriber.connection.Close()
+}
+
+func marketDataHandler(w http.ResponseWriter, r *http.Request) {
+	connection, err := MARKET_DATA_UPGRADER.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader has already replied with an error
+		log.Printf("Unable to upgrade the connection to WebSocket. Error: %v", err)
+		return
+	}
+	subscriber := MARKET_DATA_FEED.addSubscriber(connection)
+	log.Printf("Market data subscriber %v has connected.", connection.RemoteAddr())
+	go subscriber.writeMessages()
+	for {
+		var request MarketDataRequest
+		_, data, err := connection.ReadMessage()
+		if err != nil {
+			log.Printf("Market data subscriber %v has disconnected. Error: %v", connection.RemoteAddr(), err)
+			break
+		}
+		err = json.Unmarshal(data, &request)
+		if err != nil {
+			log.Printf("Unable to decode MarketDataRequest from JSON. Error: %v", err)
+			request.Type = "invalid"
+		}
+		MARKET_DATA_FEED.handleRequest(subscriber, &request)
+	}
+	MARKET_DATA_FEED.removeSubscriber(subscriber)
+}
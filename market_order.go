@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
 
 	"gorm.io/gorm"
@@ -12,37 +13,54 @@ import (
 
 // A market order to buy or sell BTC.
 type MarketOrder struct {
+	// quantity in BTC, not provided if the quote amount is
 	Quantity float64
-	Type     string
+	// The USD amount to spend for buying or to receive for selling, before the fees.
+	// If provided, the order fills as much quantity as the amount is enough for.
+	QuoteAmount float64 `json:"quote_amount"`
+	Type        string
+	// IOC (immediate-or-cancel, the default) fills whatever it can,
+	// FOK (fill-or-kill) is performed only if it can be filled in full
+	TimeInForce string `json:"time_in_force"`
+	// Optional bounds on the USD price for one BTC of the matched standing orders,
+	// the maximum price for buying and the minimum price for selling.
+	MaxPrice float64 `json:"max_price"`
+	MinPrice float64 `json:"min_price"`
+	// Optional bound on the price of the matched standing orders
+	// in basis points away from the best opposite price at the time of the order.
+	// The tighter bound applies if both kinds of bounds are provided.
+	MaxSlippageBps int64 `json:"max_slippage_bps"`
 }
 
 type MarketOrderOutcome struct {
 	Quantity     float64
 	AveragePrice float64 `json:"average_price"`
+	// the USD amount spent for buying or received for selling, before the fees
+	QuoteAmount float64 `json:"quote_amount"`
+	// the taker fee paid in the currency received, BTC for buying and USD for selling
+	Fee         float64
+	FeeCurrency string `json:"fee_currency"`
+	// The quantity in BTC or, for the orders by the quote amount, the USD amount
+	// which has not been filled and the reason,
+	// which is NO_LIQUIDITY, PRICE_BOUND or INSUFFICIENT_BALANCE,
+	// or empty if the order has been filled in full.
+	// The cents left over from the quote amount after the last whole Satoshi
+	// are unfilled without a reason.
+	UnfilledQuantity    float64 `json:"unfilled_quantity"`
+	UnfilledQuoteAmount float64 `json:"unfilled_quote_amount"`
+	UnfilledReason      string  `json:"unfilled_reason"`
 }
 
 var NO_MATCHING_STANDING_ORDERS = errors.New("No matching standing orders.")
-
-func getStandingSellOrders(tx *gorm.DB, satoshiUsdCentsLimitPrice float64, offset int64, size int64) (standingOrders []*StandingOrder, err error) {
-	var result *gorm.DB
-	if satoshiUsdCentsLimitPrice == 0 {
-		result = tx.Preload("User").Where(&StandingOrder{Type: "SELL", State: "LIVE"}).Offset(int(offset)).Limit(int(size)).Order("limit_price asc").Find(&standingOrders)
-	} else {
-		result = tx.Preload("User").Where(&StandingOrder{Type: "SELL", State: "LIVE"}).Where("limit_price <= ?", satoshiUsdCentsLimitPrice).Offset(int(offset)).Limit(int(size)).Order("limit_price asc").Find(&standingOrders)
-	}
-	log.Printf("DB result: Type: %T, Value: %v", result, result)
-	if err := result.Error; err != nil {
-		return nil, err
-	}
-	if result.RowsAffected < size {
-		return standingOrders, NO_MATCHING_STANDING_ORDERS
-	}
-	return standingOrders, nil
-}
+var NOT_FILLED_IN_FULL = errors.New("Unable to fill the order in full.")
 
 // Buy the specified amount of Satoshis via the provided standing order
 // using the current user's cash balance.
-func (user *User) BuyViaStandingOrder(tx *gorm.DB, standingOrder *StandingOrder, satoshiAmount int64) (satisfiedSatoshiAmount int64, transactionUsdCentsAmount int64, fundsExhausted bool) {
+// The taker order ID is the ID of the current user's standing order
+// on whose behalf the Satoshis are bought, or zero in case of a market order.
+// The current user pays the taker fee in Satoshis
+// and the seller pays the maker fee in USD cents.
+func (user *User) BuyViaStandingOrder(tx *gorm.DB, takerOrderId int64, standingOrder *StandingOrder, satoshiAmount int64) (satisfiedSatoshiAmount int64, transactionUsdCentsAmount int64, takerFee int64, fundsExhausted bool) {
 	seller := standingOrder.User
 	fundsExhausted = false
 	// The first estimate of the satisfied Satoshi amount is the requested Satoshi amount.
@@ -54,19 +72,35 @@ func (user *User) BuyViaStandingOrder(tx *gorm.DB, standingOrder *StandingOrder,
 	}
 	// Assuming that the other party (seller in this case)
 	// can always satisfy the remaining order's quantity at its limit price.
-	if satisfiedSatoshiAmount > standingOrder.RemainingQuantity {
-		satisfiedSatoshiAmount = standingOrder.RemainingQuantity
+	// Only the visible part of an iceberg order is matched at once.
+	if satisfiedSatoshiAmount > standingOrder.GetMatchableQuantity() {
+		satisfiedSatoshiAmount = standingOrder.GetMatchableQuantity()
 		fundsExhausted = false
 	}
+	if satisfiedSatoshiAmount <= 0 {
+		// Nothing is traded, e.g. because the current user cannot afford a single Satoshi,
+		// so neither the balances nor the standing order are changed.
+		return 0, 0, 0, fundsExhausted
+	}
 	// No checks are done at this point
 	// because the invariant of users having enough funds
 	// to satisfy the remaining quantities of all their live orders at limit prices
 	// is supposed to always be true.
 	transactionUsdCentsAmountFloat := float64(satisfiedSatoshiAmount) * standingOrder.LimitPrice
 	transactionUsdCentsAmount = int64(transactionUsdCentsAmountFloat)
+	takerFeeBps, err := getFeeBps(tx, user.ID, false)
+	if err != nil {
+		panic(err)
+	}
+	makerFeeBps, err := getFeeBps(tx, seller.ID, true)
+	if err != nil {
+		panic(err)
+	}
+	takerFee = computeFee(satisfiedSatoshiAmount, takerFeeBps)
+	makerFee := computeFee(transactionUsdCentsAmount, makerFeeBps)
 	user.USDCentsBalance -= transactionUsdCentsAmount
-	seller.USDCentsBalance += transactionUsdCentsAmount
-	user.BTCSatoshiBalance += satisfiedSatoshiAmount
+	seller.USDCentsBalance += transactionUsdCentsAmount - makerFee
+	user.BTCSatoshiBalance += satisfiedSatoshiAmount - takerFee
 	seller.BTCSatoshiBalance -= satisfiedSatoshiAmount
 	standingOrder.AveragePrice = (standingOrder.AveragePrice*float64(standingOrder.FulfilledQuantity) + transactionUsdCentsAmountFloat) / float64(standingOrder.FulfilledQuantity+satisfiedSatoshiAmount)
 	standingOrder.FulfilledQuantity += satisfiedSatoshiAmount
@@ -74,6 +108,14 @@ func (user *User) BuyViaStandingOrder(tx *gorm.DB, standingOrder *StandingOrder,
 	if standingOrder.RemainingQuantity == 0 {
 		standingOrder.State = "FULFILLED"
 	}
+	err = standingOrder.consumeVisibleQuantity(tx, satisfiedSatoshiAmount)
+	if err != nil {
+		panic(err)
+	}
+	err = creditFees(tx, makerFee, takerFee, user, &seller)
+	if err != nil {
+		panic(err)
+	}
 	result := tx.Save(standingOrder)
 	if err := result.Error; err != nil {
 		panic(err)
@@ -87,99 +129,113 @@ func (user *User) BuyViaStandingOrder(tx *gorm.DB, standingOrder *StandingOrder,
 	if err := result.Error; err != nil {
 		panic(err)
 	}
-	standingOrder.PerformWebhookRequest()
-	return satisfiedSatoshiAmount, transactionUsdCentsAmount, fundsExhausted
+	_, err = recordTrade(tx, standingOrder, user.ID, takerOrderId, satisfiedSatoshiAmount, transactionUsdCentsAmount, makerFee, takerFee)
+	if err != nil {
+		panic(err)
+	}
+	err = standingOrder.EnqueueWebhook(tx, "ORDER_FILLED")
+	if err != nil {
+		panic(err)
+	}
+	_, err = standingOrder.CancelLinkedOrder(tx)
+	if err != nil {
+		panic(err)
+	}
+	return satisfiedSatoshiAmount, transactionUsdCentsAmount, takerFee, fundsExhausted
 }
 
 // Buy the provided amount of Satoshis, if possible,
 // by satisfying the existing standing orders
 // using the user's available USD cents balance.
-func (user *User) BuySatoshis(tx *gorm.DB, remainingSatoshiAmount int64, satoshiUsdCentsLimitPrice float64) (satisfiedSatoshiAmount int64, averageSatoshiUsdCentsPrice float64, err error) {
-	var size int64 = 10
+// If the provided USD cents amount limit is nonzero, at most that amount is spent
+// and the provided amount of Satoshis can be math.MaxInt64 to buy as many as possible.
+// The returned reason why the order has not been satisfied in full is empty if it has been.
+func (user *User) BuySatoshis(tx *gorm.DB, takerOrderId int64, remainingSatoshiAmount int64, usdCentsAmountLimit int64, satoshiUsdCentsLimitPrice float64) (satisfiedSatoshiAmount int64, usdCentsAmount int64, takerFee int64, unfilledReason string, err error) {
 	satisfiedSatoshiAmount = 0
-	var usdCentsAmount int64 = 0
+	usdCentsAmount = 0
+	takerFee = 0
 	fundsExhausted := false
+	usdCentsAmountLimitReached := false
 	defer func() {
 		if p := recover(); p != nil {
 			// modifying the function's return value
 			err = fmt.Errorf("The transaction has been rolled back because of the following panic: %v", p)
 		}
 	}()
-outerLoop:
-	for offset := int64(0); remainingSatoshiAmount > 0; offset += size {
-		standingOrders, err := getStandingSellOrders(tx, satoshiUsdCentsLimitPrice, offset, size)
-		log.Printf("Standing orders: Type: %T, Value: %v", standingOrders, standingOrders)
-		if err != nil && !errors.Is(err, NO_MATCHING_STANDING_ORDERS) {
-			return 0, 0, err
+	for remainingSatoshiAmount > 0 && !fundsExhausted && !usdCentsAmountLimitReached {
+		bookOrder := ORDER_BOOK.BestOrder("SELL", satoshiUsdCentsLimitPrice)
+		if bookOrder == nil {
+			// no more matching orders exist
+			break
+		}
+		standingOrder, err := getStandingOrderFromDb(tx.Preload("User"), bookOrder.ID)
+		if err != nil {
+			return 0, 0, 0, "", err
 		}
-		for _, standingOrder := range standingOrders {
-			log.Printf("Standing order: Type: %T, Value: %v", standingOrder, standingOrder)
-			satisfiedSatoshiAmountFromOrder, transactionUsdCentsAmount, fundsExhausted := user.BuyViaStandingOrder(tx, standingOrder, remainingSatoshiAmount)
-			usdCentsAmount += transactionUsdCentsAmount
-			satisfiedSatoshiAmount += satisfiedSatoshiAmountFromOrder
-			remainingSatoshiAmount -= satisfiedSatoshiAmountFromOrder
-			if remainingSatoshiAmount == 0 {
-				break
+		log.Printf("Standing order: Type: %T, Value: %v", standingOrder, standingOrder)
+		if standingOrder.State == "LIVE" && standingOrder.IsExpired() {
+			// the expiry sweeper has not got to the order yet
+			err = standingOrder.Expire(tx)
+			if err != nil {
+				return 0, 0, 0, "", err
 			}
-			if fundsExhausted {
-				break outerLoop
+		}
+		if standingOrder.State != "LIVE" {
+			// the order book is out of date
+			ORDER_BOOK.Update(standingOrder)
+			continue
+		}
+		if standingOrder.GetMatchableQuantity() <= 0 {
+			// the maker order has nothing to match, unlike the ones behind it
+			log.Printf("Skipping the standing order %v without any matchable quantity.", standingOrder)
+			ORDER_BOOK.Drop(standingOrder.ID)
+			continue
+		}
+		satoshiAmount := remainingSatoshiAmount
+		limitedByUsdCentsAmount := false
+		if usdCentsAmountLimit != 0 {
+			// the whole Satoshis whose price fits into the rest of the USD cents amount,
+			// the cents left over are not used
+			satoshiAmountForUsdCents := int64(float64(usdCentsAmountLimit-usdCentsAmount) / standingOrder.LimitPrice)
+			if satoshiAmountForUsdCents <= satoshiAmount {
+				satoshiAmount = satoshiAmountForUsdCents
+				limitedByUsdCentsAmount = true
 			}
 		}
-		if errors.Is(err, NO_MATCHING_STANDING_ORDERS) {
-			// no more matching orders exist
+		if satoshiAmount == 0 {
+			usdCentsAmountLimitReached = true
 			break
 		}
-	}
-	if satisfiedSatoshiAmount == 0 {
-		return 0, 0, NO_MATCHING_STANDING_ORDERS
-	}
-	if remainingSatoshiAmount > 0 {
-		log.Print("Unable to satisfy the order in full quantity.")
+		var satisfiedSatoshiAmountFromOrder, transactionUsdCentsAmount, takerFeeFromOrder int64
+		satisfiedSatoshiAmountFromOrder, transactionUsdCentsAmount, takerFeeFromOrder, fundsExhausted = user.BuyViaStandingOrder(tx, takerOrderId, standingOrder, satoshiAmount)
+		ORDER_BOOK.Update(standingOrder)
+		usdCentsAmount += transactionUsdCentsAmount
+		takerFee += takerFeeFromOrder
+		satisfiedSatoshiAmount += satisfiedSatoshiAmountFromOrder
+		remainingSatoshiAmount -= satisfiedSatoshiAmountFromOrder
+		usdCentsAmountLimitReached = limitedByUsdCentsAmount && satisfiedSatoshiAmountFromOrder == satoshiAmount
+	}
+	if remainingSatoshiAmount > 0 && !usdCentsAmountLimitReached {
 		if fundsExhausted {
-			log.Print("Reason: Insufficient cash balance.")
+			unfilledReason = "INSUFFICIENT_BALANCE"
 		} else {
-			log.Print("Reason: No matching orders.")
+			unfilledReason = getNoMatchingReason("SELL")
 		}
+		log.Printf("Unable to satisfy the order in full quantity. Reason: %v", unfilledReason)
 	}
-	averageSatoshiUsdCentsPrice = float64(usdCentsAmount) / float64(satisfiedSatoshiAmount)
-	return satisfiedSatoshiAmount, averageSatoshiUsdCentsPrice, nil
-}
-
-// Buy the provided amount of Bitcoin, if possible,
-// by satisfying the existing standing orders
-// using the user's available USD balance.
-// If the provided limit price is nonzero,
-// limit the matched standing orders to the ones
-// whose sell price is at most as high as the provided limit price.
-func (user *User) Buy(tx *gorm.DB, amount float64, limitPrice float64) (satisfiedQuantity float64, averagePrice float64, err error) {
-	remainingSatoshiAmount := int64(amount * 100000000)
-	satoshiUsdCentsLimitPrice := limitPrice / 1000000
-	satisfiedSatoshiAmount, averageSatoshiUsdCentsPrice, err := user.BuySatoshis(tx, remainingSatoshiAmount, satoshiUsdCentsLimitPrice)
-	satisfiedQuantity = float64(satisfiedSatoshiAmount) / 100000000
-	averagePrice = averageSatoshiUsdCentsPrice * 1000000
-	return satisfiedQuantity, averagePrice, err
-}
-
-func getStandingBuyOrders(tx *gorm.DB, satoshiUsdCentsLimitPrice float64, offset int64, size int64) (standingOrders []*StandingOrder, err error) {
-	var result *gorm.DB
-	if satoshiUsdCentsLimitPrice == 0 {
-		result = tx.Preload("User").Where(&StandingOrder{Type: "BUY", State: "LIVE"}).Offset(int(offset)).Limit(int(size)).Order("limit_price desc").Find(&standingOrders)
-	} else {
-		result = tx.Preload("User").Where(&StandingOrder{Type: "BUY", State: "LIVE"}).Where("limit_price >= ?", satoshiUsdCentsLimitPrice).Offset(int(offset)).Limit(int(size)).Order("limit_price desc").Find(&standingOrders)
-	}
-	log.Printf("DB result: Type: %T, Value: %v", result, result)
-	if err := result.Error; err != nil {
-		return nil, err
-	}
-	if result.RowsAffected < size {
-		return standingOrders, NO_MATCHING_STANDING_ORDERS
+	if satisfiedSatoshiAmount == 0 {
+		return 0, 0, 0, unfilledReason, NO_MATCHING_STANDING_ORDERS
 	}
-	return standingOrders, nil
+	return satisfiedSatoshiAmount, usdCentsAmount, takerFee, unfilledReason, nil
 }
 
 // Sell the specified amount of the current user's Satoshis
 // via the provided standing order.
-func (user *User) SellViaStandingOrder(tx *gorm.DB, standingOrder *StandingOrder, satoshiAmount int64) (satisfiedSatoshiAmount int64, transactionUsdCentsAmount int64, satoshisExhausted bool) {
+// The taker order ID is the ID of the current user's standing order
+// on whose behalf the Satoshis are sold, or zero in case of a market order.
+// The current user pays the taker fee in USD cents
+// and the buyer pays the maker fee in Satoshis.
+func (user *User) SellViaStandingOrder(tx *gorm.DB, takerOrderId int64, standingOrder *StandingOrder, satoshiAmount int64) (satisfiedSatoshiAmount int64, transactionUsdCentsAmount int64, takerFee int64, satoshisExhausted bool) {
 	buyer := standingOrder.User
 	satoshisExhausted = false
 	// The first estimate of the satisfied Satoshi amount is the requested Satoshi amount.
@@ -191,26 +247,50 @@ func (user *User) SellViaStandingOrder(tx *gorm.DB, standingOrder *StandingOrder
 	}
 	// Assuming that the other party (buyer in this case)
 	// can always satisfy the remaining order's quantity at its limit price.
-	if satisfiedSatoshiAmount > standingOrder.RemainingQuantity {
-		satisfiedSatoshiAmount = standingOrder.RemainingQuantity
+	// Only the visible part of an iceberg order is matched at once.
+	if satisfiedSatoshiAmount > standingOrder.GetMatchableQuantity() {
+		satisfiedSatoshiAmount = standingOrder.GetMatchableQuantity()
 		satoshisExhausted = false
 	}
+	if satisfiedSatoshiAmount <= 0 {
+		// Nothing is traded, e.g. because the current user cannot afford a single Satoshi,
+		// so neither the balances nor the standing order are changed.
+		return 0, 0, 0, satoshisExhausted
+	}
 	// No checks are done at this point
 	// because the invariant of users having enough BTC
 	// to satisfy the remaining quantities of all their live orders
 	// is supposed to always be true.
 	transactionUsdCentsAmountFloat := float64(satisfiedSatoshiAmount) * standingOrder.LimitPrice
 	transactionUsdCentsAmount = int64(transactionUsdCentsAmountFloat)
-	user.USDCentsBalance += transactionUsdCentsAmount
+	takerFeeBps, err := getFeeBps(tx, user.ID, false)
+	if err != nil {
+		panic(err)
+	}
+	makerFeeBps, err := getFeeBps(tx, buyer.ID, true)
+	if err != nil {
+		panic(err)
+	}
+	takerFee = computeFee(transactionUsdCentsAmount, takerFeeBps)
+	makerFee := computeFee(satisfiedSatoshiAmount, makerFeeBps)
+	user.USDCentsBalance += transactionUsdCentsAmount - takerFee
 	buyer.USDCentsBalance -= transactionUsdCentsAmount
 	user.BTCSatoshiBalance -= satisfiedSatoshiAmount
-	buyer.BTCSatoshiBalance += satisfiedSatoshiAmount
+	buyer.BTCSatoshiBalance += satisfiedSatoshiAmount - makerFee
 	standingOrder.AveragePrice = (standingOrder.AveragePrice*float64(standingOrder.FulfilledQuantity) + transactionUsdCentsAmountFloat) / float64(standingOrder.FulfilledQuantity+satisfiedSatoshiAmount)
 	standingOrder.FulfilledQuantity += satisfiedSatoshiAmount
 	standingOrder.RemainingQuantity -= satisfiedSatoshiAmount
 	if standingOrder.RemainingQuantity == 0 {
 		standingOrder.State = "FULFILLED"
 	}
+	err = standingOrder.consumeVisibleQuantity(tx, satisfiedSatoshiAmount)
+	if err != nil {
+		panic(err)
+	}
+	err = creditFees(tx, takerFee, makerFee, user, &buyer)
+	if err != nil {
+		panic(err)
+	}
 	result := tx.Save(standingOrder)
 	if err := result.Error; err != nil {
 		panic(err)
@@ -224,135 +304,289 @@ func (user *User) SellViaStandingOrder(tx *gorm.DB, standingOrder *StandingOrder
 	if err := result.Error; err != nil {
 		panic(err)
 	}
-	standingOrder.PerformWebhookRequest()
-	return satisfiedSatoshiAmount, transactionUsdCentsAmount, satoshisExhausted
+	_, err = recordTrade(tx, standingOrder, user.ID, takerOrderId, satisfiedSatoshiAmount, transactionUsdCentsAmount, makerFee, takerFee)
+	if err != nil {
+		panic(err)
+	}
+	err = standingOrder.EnqueueWebhook(tx, "ORDER_FILLED")
+	if err != nil {
+		panic(err)
+	}
+	_, err = standingOrder.CancelLinkedOrder(tx)
+	if err != nil {
+		panic(err)
+	}
+	return satisfiedSatoshiAmount, transactionUsdCentsAmount, takerFee, satoshisExhausted
 }
 
 // Sell the provided amount of user's Satoshis, if possible,
 // by satisfying the existing standing orders
 // using the user's available Satoshi balance.
-func (user *User) SellSatoshis(tx *gorm.DB, remainingSatoshiAmount int64, satoshiUsdCentsLimitPrice float64) (satisfiedSatoshiAmount int64, averageSatoshiUsdCentsPrice float64, err error) {
-	var size int64 = 10
+// If the provided USD cents amount limit is nonzero, at most that amount is received
+// and the provided amount of Satoshis can be math.MaxInt64 to sell as many as possible.
+// The returned reason why the order has not been satisfied in full is empty if it has been.
+func (user *User) SellSatoshis(tx *gorm.DB, takerOrderId int64, remainingSatoshiAmount int64, usdCentsAmountLimit int64, satoshiUsdCentsLimitPrice float64) (satisfiedSatoshiAmount int64, usdCentsAmount int64, takerFee int64, unfilledReason string, err error) {
 	satisfiedSatoshiAmount = 0
-	var usdCentsAmount int64 = 0
+	usdCentsAmount = 0
+	takerFee = 0
 	satoshisExhausted := false
+	usdCentsAmountLimitReached := false
 	defer func() {
 		if p := recover(); p != nil {
 			// modifying the function's return value
 			err = fmt.Errorf("The transaction has been rolled back because of the following panic: %v", p)
 		}
 	}()
-outerLoop:
-	for offset := int64(0); remainingSatoshiAmount > 0; offset += size {
-		standingOrders, err := getStandingBuyOrders(tx, satoshiUsdCentsLimitPrice, offset, size)
-		log.Printf("Standing orders: Type: %T, Value: %v", standingOrders, standingOrders)
-		if err != nil && !errors.Is(err, NO_MATCHING_STANDING_ORDERS) {
-			return 0, 0, err
+	for remainingSatoshiAmount > 0 && !satoshisExhausted && !usdCentsAmountLimitReached {
+		bookOrder := ORDER_BOOK.BestOrder("BUY", satoshiUsdCentsLimitPrice)
+		if bookOrder == nil {
+			// no more matching orders exist
+			break
+		}
+		standingOrder, err := getStandingOrderFromDb(tx.Preload("User"), bookOrder.ID)
+		if err != nil {
+			return 0, 0, 0, "", err
 		}
-		for _, standingOrder := range standingOrders {
-			log.Printf("Standing order: Type: %T, Value: %v", standingOrder, standingOrder)
-			satisfiedSatoshiAmountFromOrder, transactionUsdCentsAmount, satoshisExhausted := user.SellViaStandingOrder(tx, standingOrder, remainingSatoshiAmount)
-			usdCentsAmount += transactionUsdCentsAmount
-			satisfiedSatoshiAmount += satisfiedSatoshiAmountFromOrder
-			remainingSatoshiAmount -= satisfiedSatoshiAmountFromOrder
-			if remainingSatoshiAmount == 0 {
-				break
+		log.Printf("Standing order: Type: %T, Value: %v", standingOrder, standingOrder)
+		if standingOrder.State == "LIVE" && standingOrder.IsExpired() {
+			// the expiry sweeper has not got to the order yet
+			err = standingOrder.Expire(tx)
+			if err != nil {
+				return 0, 0, 0, "", err
 			}
-			if satoshisExhausted {
-				break outerLoop
+		}
+		if standingOrder.State != "LIVE" {
+			// the order book is out of date
+			ORDER_BOOK.Update(standingOrder)
+			continue
+		}
+		if standingOrder.GetMatchableQuantity() <= 0 {
+			// the maker order has nothing to match, unlike the ones behind it
+			log.Printf("Skipping the standing order %v without any matchable quantity.", standingOrder)
+			ORDER_BOOK.Drop(standingOrder.ID)
+			continue
+		}
+		satoshiAmount := remainingSatoshiAmount
+		limitedByUsdCentsAmount := false
+		if usdCentsAmountLimit != 0 {
+			// the whole Satoshis whose price fits into the rest of the USD cents amount,
+			// the cents left over are not used
+			satoshiAmountForUsdCents := int64(float64(usdCentsAmountLimit-usdCentsAmount) / standingOrder.LimitPrice)
+			if satoshiAmountForUsdCents <= satoshiAmount {
+				satoshiAmount = satoshiAmountForUsdCents
+				limitedByUsdCentsAmount = true
 			}
 		}
-		if errors.Is(err, NO_MATCHING_STANDING_ORDERS) {
-			// no more matching orders exist
+		if satoshiAmount == 0 {
+			usdCentsAmountLimitReached = true
 			break
 		}
-	}
-	if satisfiedSatoshiAmount == 0 {
-		return 0, 0, NO_MATCHING_STANDING_ORDERS
-	}
-	if remainingSatoshiAmount > 0 {
-		log.Print("Unable to satisfy the order in full quantity.")
+		var satisfiedSatoshiAmountFromOrder, transactionUsdCentsAmount, takerFeeFromOrder int64
+		satisfiedSatoshiAmountFromOrder, transactionUsdCentsAmount, takerFeeFromOrder, satoshisExhausted = user.SellViaStandingOrder(tx, takerOrderId, standingOrder, satoshiAmount)
+		ORDER_BOOK.Update(standingOrder)
+		usdCentsAmount += transactionUsdCentsAmount
+		takerFee += takerFeeFromOrder
+		satisfiedSatoshiAmount += satisfiedSatoshiAmountFromOrder
+		remainingSatoshiAmount -= satisfiedSatoshiAmountFromOrder
+		usdCentsAmountLimitReached = limitedByUsdCentsAmount && satisfiedSatoshiAmountFromOrder == satoshiAmount
+	}
+	if remainingSatoshiAmount > 0 && !usdCentsAmountLimitReached {
 		if satoshisExhausted {
-			log.Print("Reason: Insufficient BTC balance.")
+			unfilledReason = "INSUFFICIENT_BALANCE"
 		} else {
-			log.Print("Reason: No matching orders.")
+			unfilledReason = getNoMatchingReason("BUY")
 		}
+		log.Printf("Unable to satisfy the order in full quantity. Reason: %v", unfilledReason)
 	}
-	averageSatoshiUsdCentsPrice = float64(usdCentsAmount) / float64(satisfiedSatoshiAmount)
-	return satisfiedSatoshiAmount, averageSatoshiUsdCentsPrice, nil
+	if satisfiedSatoshiAmount == 0 {
+		return 0, 0, 0, unfilledReason, NO_MATCHING_STANDING_ORDERS
+	}
+	return satisfiedSatoshiAmount, usdCentsAmount, takerFee, unfilledReason, nil
 }
 
-// Sell the provided amount of user's Bitcoin, if possible,
-// by satisfying the existing standing orders
-// using the user's available BTC balance.
-// If the provided limit price is nonzero,
-// limit the matched standing orders to the ones
-// whose buy price is at least as high as the provided limit price.
-func (user *User) Sell(tx *gorm.DB, amount float64, limitPrice float64) (satisfiedQuantity float64, averagePrice float64, err error) {
-	remainingSatoshiAmount := int64(amount * 100000000)
-	satoshiUsdCentsLimitPrice := limitPrice / 1000000
-	satisfiedSatoshiAmount, averageSatoshiUsdCentsPrice, err := user.SellSatoshis(tx, remainingSatoshiAmount, satoshiUsdCentsLimitPrice)
-	satisfiedQuantity = float64(satisfiedSatoshiAmount) / 100000000
-	averagePrice = averageSatoshiUsdCentsPrice * 1000000
-	return satisfiedQuantity, averagePrice, err
+// Get the USD cents price for one Satoshi which bounds the standing orders matched by the market order,
+// or zero if the market order is unbounded.
+// Must only be called within an order book session.
+func (marketOrder *MarketOrder) getSatoshiUsdCentsLimitPrice() float64 {
+	satoshiUsdCentsLimitPrice := marketOrder.MinPrice / 1000000
+	if marketOrder.Type == "BUY" {
+		satoshiUsdCentsLimitPrice = marketOrder.MaxPrice / 1000000
+	}
+	if marketOrder.MaxSlippageBps == 0 {
+		return satoshiUsdCentsLimitPrice
+	}
+	oppositeOrderType := getOppositeOrderType(marketOrder.Type)
+	bestPrice := ORDER_BOOK.bestPrice(oppositeOrderType)
+	if bestPrice == 0 {
+		return satoshiUsdCentsLimitPrice
+	}
+	slippage := float64(marketOrder.MaxSlippageBps) / 10000
+	slippageLimitPrice := bestPrice * (1 - slippage)
+	if marketOrder.Type == "BUY" {
+		slippageLimitPrice = bestPrice * (1 + slippage)
+	}
+	if satoshiUsdCentsLimitPrice == 0 || isPriceAcceptable(oppositeOrderType, slippageLimitPrice, satoshiUsdCentsLimitPrice) {
+		// the slippage bound is the tighter one
+		return slippageLimitPrice
+	}
+	return satoshiUsdCentsLimitPrice
+}
+
+// Get the reason why the matching has found no more standing orders of the provided type,
+// which is either that there are none or that the best one is beyond the limit price.
+// Must only be called within an order book session.
+func getNoMatchingReason(orderType string) string {
+	if ORDER_BOOK.bestPrice(orderType) == 0 {
+		return "NO_LIQUIDITY"
+	}
+	return "PRICE_BOUND"
+}
+
+// Perform the provided market order within the provided transaction,
+// which must be accompanied by an order book session.
+// The taker order ID is the ID of the stop order which has triggered the market order,
+// or zero in case of a market order requested directly.
+// A FOK market order which cannot be filled in full fails with NOT_FILLED_IN_FULL,
+// in which case the caller is expected to roll back the transaction.
+// The returned taker fee is in Satoshis for buying and in USD cents for selling.
+// The returned reason why the order has not been filled in full is empty if it has been.
+func (user *User) PerformMarketOrder(tx *gorm.DB, takerOrderId int64, marketOrder *MarketOrder) (satisfiedSatoshiAmount int64, usdCentsAmount int64, takerFee int64, unfilledReason string, err error) {
+	remainingSatoshiAmount := int64(marketOrder.Quantity * 100000000)
+	usdCentsAmountLimit := marketOrder.getUsdCentsQuoteAmount()
+	if usdCentsAmountLimit != 0 {
+		// as many Satoshis as the quote amount is enough for
+		remainingSatoshiAmount = math.MaxInt64
+	}
+	satoshiUsdCentsLimitPrice := marketOrder.getSatoshiUsdCentsLimitPrice()
+	if marketOrder.Type == "BUY" {
+		satisfiedSatoshiAmount, usdCentsAmount, takerFee, unfilledReason, err = user.BuySatoshis(tx, takerOrderId, remainingSatoshiAmount, usdCentsAmountLimit, satoshiUsdCentsLimitPrice)
+	} else { // marketOrder.Type == "SELL"
+		satisfiedSatoshiAmount, usdCentsAmount, takerFee, unfilledReason, err = user.SellSatoshis(tx, takerOrderId, remainingSatoshiAmount, usdCentsAmountLimit, satoshiUsdCentsLimitPrice)
+	}
+	if errors.Is(err, NO_MATCHING_STANDING_ORDERS) {
+		return 0, 0, 0, unfilledReason, err
+	}
+	if err != nil {
+		return 0, 0, 0, "", err
+	}
+	if marketOrder.TimeInForce == "FOK" && unfilledReason != "" {
+		log.Printf("Unable to fill the fill-or-kill market order %v in full. Only %v BTC could be filled.", marketOrder, float64(satisfiedSatoshiAmount)/100000000)
+		return 0, 0, 0, unfilledReason, NOT_FILLED_IN_FULL
+	}
+	return satisfiedSatoshiAmount, usdCentsAmount, takerFee, unfilledReason, nil
+}
+
+// Get the quote amount of the market order in USD cents, zero if the order is by quantity.
+func (marketOrder *MarketOrder) getUsdCentsQuoteAmount() int64 {
+	// rounding avoids losing a cent to the binary representation of the USD amount
+	return int64(math.Round(marketOrder.QuoteAmount * 100))
+}
+
+// Get the outcome of the provided market order from the amounts in Satoshis and USD cents.
+func newMarketOrderOutcome(marketOrder *MarketOrder, satisfiedSatoshiAmount int64, usdCentsAmount int64, takerFee int64, unfilledReason string) *MarketOrderOutcome {
+	outcome := &MarketOrderOutcome{
+		Quantity:       float64(satisfiedSatoshiAmount) / 100000000,
+		QuoteAmount:    float64(usdCentsAmount) / 100,
+		UnfilledReason: unfilledReason,
+	}
+	if satisfiedSatoshiAmount > 0 {
+		outcome.AveragePrice = float64(usdCentsAmount) / float64(satisfiedSatoshiAmount) * 1000000
+	}
+	if marketOrder.QuoteAmount != 0 {
+		outcome.UnfilledQuoteAmount = float64(marketOrder.getUsdCentsQuoteAmount()-usdCentsAmount) / 100
+	} else {
+		outcome.UnfilledQuantity = float64(int64(marketOrder.Quantity*100000000)-satisfiedSatoshiAmount) / 100000000
+	}
+	if marketOrder.Type == "BUY" {
+		outcome.Fee = float64(takerFee) / 100000000
+		outcome.FeeCurrency = "BTC"
+	} else { // marketOrder.Type == "SELL"
+		outcome.Fee = float64(takerFee) / 100
+		outcome.FeeCurrency = "USD"
+	}
+	return outcome
+}
+
+func getMarketOrderFromRequest(r *http.Request) (*MarketOrder, error) {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	marketOrder := MarketOrder{}
+	err := decoder.Decode(&marketOrder)
+	if err != nil {
+		log.Printf("Unable to decode request body from JSON. Error: %v", err)
+		return nil, err
+	}
+	if marketOrder.Type != "BUY" && marketOrder.Type != "SELL" {
+		return nil, fmt.Errorf("Unknown type %v of market order has been provided.", marketOrder.Type)
+	}
+	if marketOrder.TimeInForce == "" {
+		marketOrder.TimeInForce = "IOC"
+	}
+	if marketOrder.TimeInForce != "IOC" && marketOrder.TimeInForce != "FOK" {
+		return nil, fmt.Errorf("Unsupported time in force %v of market order has been provided.", marketOrder.TimeInForce)
+	}
+	if marketOrder.Quantity < 0 || marketOrder.QuoteAmount < 0 || (marketOrder.Quantity == 0) == (marketOrder.QuoteAmount == 0) {
+		return nil, fmt.Errorf("Exactly one of the quantity %v and the quote amount %v of market order needs to be provided.", marketOrder.Quantity, marketOrder.QuoteAmount)
+	}
+	if marketOrder.MaxPrice < 0 || marketOrder.MinPrice < 0 {
+		return nil, fmt.Errorf("Invalid price bounds %v and %v of market order have been provided.", marketOrder.MaxPrice, marketOrder.MinPrice)
+	}
+	if (marketOrder.Type == "BUY" && marketOrder.MinPrice != 0) || (marketOrder.Type == "SELL" && marketOrder.MaxPrice != 0) {
+		return nil, errors.New("Only the maximum price can bound a market order to buy and only the minimum price a market order to sell.")
+	}
+	if marketOrder.MaxSlippageBps < 0 || marketOrder.MaxSlippageBps >= 10000 {
+		return nil, fmt.Errorf("The maximum slippage %v of market order is out of the allowed range from 0 to 9999 basis points.", marketOrder.MaxSlippageBps)
+	}
+	return &marketOrder, nil
 }
 
 func marketOrderHandler(w http.ResponseWriter, r *http.Request) {
+	// the order book session needs to start before the transaction
+	// so that the transaction sees the changes made by the previous sessions
+	ORDER_BOOK.Begin()
 	tx := DB.Begin()
 	user := getAuthenticatedUser(tx, r)
 	if user == nil {
 		tx.Rollback()
+		ORDER_BOOK.Rollback()
 		log.Printf("Unable to get authenticated user.")
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
-	decoder := json.NewDecoder(r.Body)
-	decoder.DisallowUnknownFields()
-	marketOrder := MarketOrder{}
-	log.Printf("Request data: Type: %T, Value: %v", marketOrder, marketOrder)
-	err := decoder.Decode(&marketOrder)
+	marketOrder, err := getMarketOrderFromRequest(r)
 	if err != nil {
 		tx.Rollback()
-		log.Printf("Unable to decode request body from JSON. Error: %v", err)
+		ORDER_BOOK.Rollback()
+		log.Printf("Unable to get market order from request. Error: %v", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 	log.Printf("Market order request for user %v: %v", user.ID, marketOrder)
-	if marketOrder.Type != "BUY" && marketOrder.Type != "SELL" {
-		tx.Rollback()
-		log.Printf("Unknown type %v of market order has been provided.", marketOrder.Type)
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-	var satisfiedQuantity, averagePrice float64
-	if marketOrder.Type == "BUY" {
-		satisfiedQuantity, averagePrice, err = user.Buy(tx, marketOrder.Quantity, 0)
-	} else { // marketOrder.Type == "SELL"
-		satisfiedQuantity, averagePrice, err = user.Sell(tx, marketOrder.Quantity, 0)
-	}
-	if errors.Is(err, NO_MATCHING_STANDING_ORDERS) {
+	satisfiedSatoshiAmount, usdCentsAmount, takerFee, unfilledReason, err := user.PerformMarketOrder(tx, 0, marketOrder)
+	if errors.Is(err, NO_MATCHING_STANDING_ORDERS) || errors.Is(err, NOT_FILLED_IN_FULL) {
 		tx.Rollback()
-		log.Println("No matching standing order.")
+		ORDER_BOOK.Rollback()
+		log.Printf("Market order %v has not been filled. Reason: %v", marketOrder, unfilledReason)
 		w.WriteHeader(http.StatusConflict)
-		return
-	}
-	if err != nil {
+		// the output will still contain the reason
+	} else if err != nil {
 		tx.Rollback()
+		ORDER_BOOK.Rollback()
 		log.Printf("Unable to perform the requested market order %v. Error: %v", marketOrder, err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
-	}
-	result := tx.Commit()
-	if err := result.Error; err != nil {
-		tx.Rollback()
-		log.Printf("Unable to commit the transaction. Error: %v", result.Error)
-		return
+	} else {
+		result := tx.Commit()
+		if err := result.Error; err != nil {
+			tx.Rollback()
+			ORDER_BOOK.Rollback()
+			log.Printf("Unable to commit the transaction. Error: %v", result.Error)
+			return
+		}
+		ORDER_BOOK.Commit()
 	}
 	// transaction is no longer in progress here
-	outcome := MarketOrderOutcome{
-		Quantity:     satisfiedQuantity,
-		AveragePrice: averagePrice,
-	}
+	outcome := newMarketOrderOutcome(marketOrder, satisfiedSatoshiAmount, usdCentsAmount, takerFee, unfilledReason)
 	log.Printf("Market order outcome: %v", outcome)
 	output, err := json.Marshal(outcome)
 	if err != nil {
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+)
+
+// The expected outcome of a market order which has not been performed.
+type MarketOrderQuote struct {
+	*MarketOrderOutcome
+	// the least favourable USD price for one BTC among the matched standing orders
+	WorstPrice float64 `json:"worst_price"`
+}
+
+// Get the expected outcome of the provided market order
+// by walking the live standing orders in the order book in the order in which they would be matched,
+// without changing any balances or standing orders.
+// The price bounds, the taker fees and the limits by the user's balance and by the quote amount
+// are applied in the same way as when the market order is performed.
+// The iceberg orders are counted with their whole remaining quantity
+// because their hidden parts are replenished at the same limit price.
+// Like PerformMarketOrder, it fails with NO_MATCHING_STANDING_ORDERS or NOT_FILLED_IN_FULL
+// together with the quote which explains the reason,
+// but the quote of a FOK market order contains the quantity which could have been filled.
+func (user *User) QuoteMarketOrder(marketOrder *MarketOrder) (*MarketOrderQuote, error) {
+	takerFeeBps, err := getFeeBps(DB, user.ID, false)
+	if err != nil {
+		log.Printf("Unable to quote the market order %v. Error: %v", marketOrder, err)
+		return nil, err
+	}
+	// the order book is only read in the session
+	ORDER_BOOK.Begin()
+	defer ORDER_BOOK.Commit()
+	remainingSatoshiAmount := int64(marketOrder.Quantity * 100000000)
+	usdCentsAmountLimit := marketOrder.getUsdCentsQuoteAmount()
+	if usdCentsAmountLimit != 0 {
+		// as many Satoshis as the quote amount is enough for
+		remainingSatoshiAmount = math.MaxInt64
+	}
+	satoshiUsdCentsLimitPrice := marketOrder.getSatoshiUsdCentsLimitPrice()
+	oppositeOrderType := getOppositeOrderType(marketOrder.Type)
+	var satisfiedSatoshiAmount, usdCentsAmount, takerFee int64 = 0, 0, 0
+	var worstSatoshiUsdCentsPrice float64 = 0
+	usdCentsBalance := user.USDCentsBalance
+	satoshiBalance := user.BTCSatoshiBalance
+	balanceExhausted := false
+	usdCentsAmountLimitReached := false
+	priceBoundReached := false
+	for _, level := range *ORDER_BOOK.side(oppositeOrderType) {
+		if remainingSatoshiAmount <= 0 || balanceExhausted || usdCentsAmountLimitReached {
+			break
+		}
+		if satoshiUsdCentsLimitPrice != 0 && !isPriceAcceptable(oppositeOrderType, level.Price, satoshiUsdCentsLimitPrice) {
+			priceBoundReached = true
+			break
+		}
+		for _, standingOrder := range level.Orders {
+			if remainingSatoshiAmount <= 0 || balanceExhausted || usdCentsAmountLimitReached {
+				break
+			}
+			if standingOrder.IsExpired() || standingOrder.RemainingQuantity <= 0 {
+				// the order would be expired or skipped instead of matched
+				continue
+			}
+			requestedSatoshiAmount := remainingSatoshiAmount
+			limitedByUsdCentsAmount := false
+			if usdCentsAmountLimit != 0 {
+				// the whole Satoshis whose price fits into the rest of the USD cents amount,
+				// the cents left over are not used
+				satoshiAmountForUsdCents := int64(float64(usdCentsAmountLimit-usdCentsAmount) / standingOrder.LimitPrice)
+				if satoshiAmountForUsdCents <= requestedSatoshiAmount {
+					requestedSatoshiAmount = satoshiAmountForUsdCents
+					limitedByUsdCentsAmount = true
+				}
+			}
+			if requestedSatoshiAmount == 0 {
+				usdCentsAmountLimitReached = true
+				break
+			}
+			satoshiAmount := requestedSatoshiAmount
+			satoshiAmountBalanceLimit := satoshiBalance
+			if marketOrder.Type == "BUY" {
+				satoshiAmountBalanceLimit = int64(float64(usdCentsBalance) / standingOrder.LimitPrice)
+			}
+			if satoshiAmount >= satoshiAmountBalanceLimit {
+				satoshiAmount = satoshiAmountBalanceLimit
+				balanceExhausted = true
+			}
+			if satoshiAmount > standingOrder.RemainingQuantity {
+				satoshiAmount = standingOrder.RemainingQuantity
+				balanceExhausted = false
+			}
+			if satoshiAmount <= 0 {
+				// the user cannot afford a single Satoshi
+				break
+			}
+			transactionUsdCentsAmount := int64(float64(satoshiAmount) * standingOrder.LimitPrice)
+			if marketOrder.Type == "BUY" {
+				usdCentsBalance -= transactionUsdCentsAmount
+				takerFee += computeFee(satoshiAmount, takerFeeBps)
+			} else { // marketOrder.Type == "SELL"
+				satoshiBalance -= satoshiAmount
+				takerFee += computeFee(transactionUsdCentsAmount, takerFeeBps)
+			}
+			usdCentsAmount += transactionUsdCentsAmount
+			satisfiedSatoshiAmount += satoshiAmount
+			remainingSatoshiAmount -= satoshiAmount
+			usdCentsAmountLimitReached = limitedByUsdCentsAmount && satoshiAmount == requestedSatoshiAmount
+			// the levels are walked from the best price to the worst one
+			worstSatoshiUsdCentsPrice = level.Price
+		}
+	}
+	unfilledReason := ""
+	if remainingSatoshiAmount > 0 && !usdCentsAmountLimitReached {
+		if balanceExhausted {
+			unfilledReason = "INSUFFICIENT_BALANCE"
+		} else if priceBoundReached {
+			unfilledReason = "PRICE_BOUND"
+		} else {
+			unfilledReason = "NO_LIQUIDITY"
+		}
+	}
+	quote := &MarketOrderQuote{
+		MarketOrderOutcome: newMarketOrderOutcome(marketOrder, satisfiedSatoshiAmount, usdCentsAmount, takerFee, unfilledReason),
+		WorstPrice:         worstSatoshiUsdCentsPrice * 1000000,
+	}
+	if satisfiedSatoshiAmount == 0 {
+		return quote, NO_MATCHING_STANDING_ORDERS
+	}
+	if marketOrder.TimeInForce == "FOK" && unfilledReason != "" {
+		return quote, NOT_FILLED_IN_FULL
+	}
+	return quote, nil
+}
+
+func marketOrderQuoteHandler(w http.ResponseWriter, r *http.Request) {
+	tx := DB.Begin()
+	user := getAuthenticatedUser(tx, r)
+	// DB transaction is unnecessary for the quote
+	tx.Rollback()
+	if user == nil {
+		log.Printf("Unable to get authenticated user.")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	marketOrder, err := getMarketOrderFromRequest(r)
+	if err != nil {
+		log.Printf("Unable to get market order from request. Error: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	log.Printf("Market order quote request for user %v: %v", user.ID, marketOrder)
+	quote, err := user.QuoteMarketOrder(marketOrder)
+	if errors.Is(err, NO_MATCHING_STANDING_ORDERS) || errors.Is(err, NOT_FILLED_IN_FULL) {
+		log.Printf("Market order %v would not be filled. Reason: %v", marketOrder, quote.UnfilledReason)
+		w.WriteHeader(http.StatusConflict)
+		// the output will still contain the reason
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	output, err := json.Marshal(quote)
+	if err != nil {
+		log.Printf("Unable to serialize MarketOrderQuote object to JSON. Error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Write(output)
+}
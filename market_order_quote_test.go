@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestQuoteMarketOrder(t *testing.T) {
+	orderBook := ORDER_BOOK
+	feeTiers := FEE_TIERS
+	defer func() {
+		ORDER_BOOK = orderBook
+		FEE_TIERS = feeTiers
+	}()
+	// no fees, which would need the 30-day volumes from the database
+	FEE_TIERS = nil
+	expiredAt := time.Now().Add(-time.Minute)
+	ORDER_BOOK = newTestOrderBook(
+		// 0.3 BTC at 50000 USD and 0.5 BTC at 60000 USD
+		&StandingOrder{ID: 1, Type: "SELL", State: "LIVE", LimitPrice: 0.05, Sequence: 2, RemainingQuantity: 30000000},
+		&StandingOrder{ID: 2, Type: "SELL", State: "LIVE", LimitPrice: 0.06, Sequence: 3, RemainingQuantity: 50000000},
+		// skipped instead of matched
+		&StandingOrder{ID: 3, Type: "SELL", State: "LIVE", LimitPrice: 0.05, Sequence: 1, RemainingQuantity: 0},
+		&StandingOrder{ID: 4, Type: "SELL", State: "LIVE", LimitPrice: 0.05, Sequence: 4, RemainingQuantity: 10000000, TimeInForce: "GTD", ExpiresAt: &expiredAt},
+		// 0.2 BTC at 40000 USD and 0.2 BTC at 30000 USD
+		&StandingOrder{ID: 5, Type: "BUY", State: "LIVE", LimitPrice: 0.04, Sequence: 5, RemainingQuantity: 20000000},
+		&StandingOrder{ID: 6, Type: "BUY", State: "LIVE", LimitPrice: 0.03, Sequence: 6, RemainingQuantity: 20000000},
+	)
+	tests := []struct {
+		name           string
+		marketOrder    *MarketOrder
+		usdBalance     int64
+		satoshiBalance int64
+		// the expected outcome
+		err            error
+		quantity       float64
+		quoteAmount    float64
+		unfilledReason string
+		worstPrice     float64
+	}{
+		{"buying across the price levels", &MarketOrder{Type: "BUY", Quantity: 0.5, TimeInForce: "IOC"}, 10000000, 0, nil, 0.5, 27000, "", 60000},
+		{"buying at the best price", &MarketOrder{Type: "BUY", Quantity: 0.1, TimeInForce: "IOC"}, 10000000, 0, nil, 0.1, 5000, "", 50000},
+		{"buying more than offered", &MarketOrder{Type: "BUY", Quantity: 1, TimeInForce: "IOC"}, 10000000, 0, nil, 0.8, 45000, "NO_LIQUIDITY", 60000},
+		{"buying beyond the balance", &MarketOrder{Type: "BUY", Quantity: 0.5, TimeInForce: "IOC"}, 2000000, 0, nil, 0.38333333, 19999.99, "INSUFFICIENT_BALANCE", 60000},
+		{"buying beyond the maximum price", &MarketOrder{Type: "BUY", Quantity: 0.5, TimeInForce: "IOC", MaxPrice: 55000}, 10000000, 0, nil, 0.3, 15000, "PRICE_BOUND", 50000},
+		{"buying beyond the slippage", &MarketOrder{Type: "BUY", Quantity: 0.5, TimeInForce: "IOC", MaxSlippageBps: 1000}, 10000000, 0, nil, 0.3, 15000, "PRICE_BOUND", 50000},
+		{"buying for the quote amount", &MarketOrder{Type: "BUY", QuoteAmount: 20000, TimeInForce: "IOC"}, 10000000, 0, nil, 0.38333333, 19999.99, "", 60000},
+		// the quote still shows what could be filled
+		{"buying fill-or-kill beyond the maximum price", &MarketOrder{Type: "BUY", Quantity: 0.5, TimeInForce: "FOK", MaxPrice: 55000}, 10000000, 0, NOT_FILLED_IN_FULL, 0.3, 15000, "PRICE_BOUND", 50000},
+		{"buying without any balance", &MarketOrder{Type: "BUY", Quantity: 0.5, TimeInForce: "IOC"}, 0, 0, NO_MATCHING_STANDING_ORDERS, 0, 0, "INSUFFICIENT_BALANCE", 0},
+		{"selling across the price levels", &MarketOrder{Type: "SELL", Quantity: 0.3, TimeInForce: "IOC"}, 0, 100000000, nil, 0.3, 11000, "", 30000},
+		{"selling beyond the minimum price", &MarketOrder{Type: "SELL", Quantity: 0.3, TimeInForce: "IOC", MinPrice: 35000}, 0, 100000000, nil, 0.2, 8000, "PRICE_BOUND", 40000},
+		{"selling beyond the balance", &MarketOrder{Type: "SELL", Quantity: 0.3, TimeInForce: "IOC"}, 0, 10000000, nil, 0.1, 4000, "INSUFFICIENT_BALANCE", 40000},
+		{"selling above any bid", &MarketOrder{Type: "SELL", Quantity: 0.3, TimeInForce: "IOC", MinPrice: 45000}, 0, 100000000, NO_MATCHING_STANDING_ORDERS, 0, 0, "PRICE_BOUND", 0},
+	}
+	for _, test := range tests {
+		user := &User{ID: "test", USDCentsBalance: test.usdBalance, BTCSatoshiBalance: test.satoshiBalance}
+		quote, err := user.QuoteMarketOrder(test.marketOrder)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%v: The quote has failed with %v, expected %v.", test.name, err, test.err)
+			continue
+		}
+		if math.Abs(quote.Quantity-test.quantity) > 1e-9 || math.Abs(quote.QuoteAmount-test.quoteAmount) > 1e-9 {
+			t.Errorf("%v: The quote is %v BTC for %v USD, expected %v BTC for %v USD.", test.name, quote.Quantity, quote.QuoteAmount, test.quantity, test.quoteAmount)
+		}
+		if quote.UnfilledReason != test.unfilledReason {
+			t.Errorf("%v: The unfilled reason is %v, expected %v.", test.name, quote.UnfilledReason, test.unfilledReason)
+		}
+		if math.Abs(quote.WorstPrice-test.worstPrice) > 1e-6 {
+			t.Errorf("%v: The worst price is %v, expected %v.", test.name, quote.WorstPrice, test.worstPrice)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"gorm.io/gorm"
+)
+
+// A new pair of linked standing orders to buy or sell BTC,
+// typically a take-profit limit order and a stop order,
+// of which one is cancelled once the other one is filled, triggered or cancelled.
+type NewOcoOrder struct {
+	Orders []*NewStandingOrder
+}
+
+// Cancel the other order of the OCO pair of the standing order within the provided transaction,
+// if it is still live or untriggered.
+// Returns the cancelled order, if any.
+// Must only be called within an order book session.
+func (standingOrder *StandingOrder) CancelLinkedOrder(tx *gorm.DB) (*StandingOrder, error) {
+	if standingOrder.LinkedOrderId == 0 {
+		return nil, nil
+	}
+	linkedOrder, err := getStandingOrderFromDb(tx, standingOrder.LinkedOrderId)
+	if err != nil {
+		return nil, err
+	}
+	if linkedOrder.State != "LIVE" && linkedOrder.State != "UNTRIGGERED" {
+		return nil, nil
+	}
+	log.Printf("Cancelling standing order %v linked to standing order %v.", linkedOrder, standingOrder)
+	linkedOrder.State = "CANCELLED"
+	result := tx.Save(linkedOrder)
+	if err := result.Error; err != nil {
+		log.Printf("Unable to save the standing order %v. Error: %v", linkedOrder, err)
+		return nil, err
+	}
+	err = linkedOrder.EnqueueWebhook(tx, "ORDER_CANCELLED")
+	if err != nil {
+		return nil, err
+	}
+	ORDER_BOOK.Update(linkedOrder)
+	return linkedOrder, nil
+}
+
+// Create the user's OCO pair of standing orders from the provided HTTP request
+// and commit the provided transaction.
+// The live orders of the pair share the blocked balance,
+// which is the larger one of the amounts they would block on their own.
+// If the orders have been successfully created,
+// try to execute the live ones against the other standing orders.
+// The provided transaction must be accompanied by an order book session
+// started before it, which is finished together with the transaction.
+func (user *User) CreateOcoOrder(tx *gorm.DB, newOcoOrder *NewOcoOrder) ([]*StandingOrder, error) {
+	var standingOrders []*StandingOrder
+	var requiredAmount int64 = 0
+	for _, newStandingOrder := range newOcoOrder.Orders {
+		if newStandingOrder.IsStopOrder() {
+			stopOrder, err := user.newStopOrder(tx, newStandingOrder)
+			if err != nil {
+				tx.Rollback()
+				ORDER_BOOK.Rollback()
+				return nil, err
+			}
+			standingOrders = append(standingOrders, stopOrder)
+			continue
+		}
+		standingOrder := &StandingOrder{
+			Type:              newStandingOrder.Type,
+			State:             "LIVE",
+			RemainingQuantity: int64(newStandingOrder.Quantity * 100000000),
+			LimitPrice:        newStandingOrder.LimitPrice / 1000000,
+			WebhookURL:        newStandingOrder.WebhookURL,
+			UserId:            user.ID,
+			TimeInForce:       newStandingOrder.TimeInForce,
+			ExpiresAt:         newStandingOrder.ExpiresAt,
+			DisplayQuantity:   int64(newStandingOrder.DisplayQuantity * 100000000),
+		}
+		standingOrder.VisibleQuantity = standingOrder.DisplayQuantity
+		standingOrder.clampVisibleQuantity()
+		amount := standingOrder.RemainingQuantity
+		if standingOrder.Type == "BUY" {
+			amount = int64(float64(standingOrder.RemainingQuantity) * standingOrder.LimitPrice)
+		}
+		if amount > requiredAmount {
+			requiredAmount = amount
+		}
+		standingOrders = append(standingOrders, standingOrder)
+	}
+	currency := "BTC"
+	if standingOrders[0].Type == "BUY" {
+		currency = "USD"
+	}
+	availableAmount, err := user.GetAvailableAmount(tx, currency)
+	if err != nil {
+		tx.Rollback()
+		ORDER_BOOK.Rollback()
+		log.Printf("Unable to determine the available %v amount of user with ID %v. Error: %v", currency, user.ID, err)
+		return nil, err
+	}
+	if requiredAmount > availableAmount {
+		log.Printf("User with ID %v only has %v available but it is necessary to have %v available in order to fully satisfy the new OCO order %v. Marking it as cancelled.", user.ID, formatAmount(currency, availableAmount), formatAmount(currency, requiredAmount), newOcoOrder)
+		for _, standingOrder := range standingOrders {
+			standingOrder.State = "CANCELLED"
+		}
+		err = INSUFFICIENT_BALANCE
+	}
+	// the orders are linked to each other once both of them have their IDs
+	for _, standingOrder := range standingOrders {
+		result := tx.Create(standingOrder)
+		if err := result.Error; err != nil {
+			tx.Rollback()
+			ORDER_BOOK.Rollback()
+			log.Printf("Unable to create standing order %v. Error: %v", standingOrder, err)
+			return nil, err
+		}
+	}
+	standingOrders[0].LinkedOrderId = standingOrders[1].ID
+	standingOrders[1].LinkedOrderId = standingOrders[0].ID
+	for _, standingOrder := range standingOrders {
+		result := tx.Model(standingOrder).Update("linked_order_id", standingOrder.LinkedOrderId)
+		if err := result.Error; err != nil {
+			tx.Rollback()
+			ORDER_BOOK.Rollback()
+			log.Printf("Unable to save the standing order %v. Error: %v", standingOrder, err)
+			return nil, err
+		}
+	}
+	result := tx.Commit()
+	if err := result.Error; err != nil {
+		tx.Rollback()
+		ORDER_BOOK.Rollback()
+		log.Printf("Unable to commit the transaction. Error: %v", result.Error)
+		return nil, err
+	}
+	// transaction is no longer in progress here
+	for _, standingOrder := range standingOrders {
+		ORDER_BOOK.Update(standingOrder)
+	}
+	ORDER_BOOK.Commit()
+	if err != nil {
+		return standingOrders, err
+	}
+	for _, standingOrder := range standingOrders {
+		if standingOrder.State == "LIVE" {
+			go user.ExecuteStandingOrder(standingOrder)
+		} else {
+			// the last trade price might have already crossed the trigger price
+			signalStopOrders()
+		}
+	}
+	return standingOrders, nil
+}
+
+func getNewOcoOrderFromRequest(r *http.Request) (*NewOcoOrder, error) {
+	var newOcoOrder NewOcoOrder
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&newOcoOrder)
+	if err != nil {
+		log.Printf("Unable to decode NewOcoOrder from JSON. Error: %v", err)
+		return nil, err
+	}
+	if len(newOcoOrder.Orders) != 2 {
+		return nil, fmt.Errorf("An OCO order consists of 2 standing orders but %v have been provided.", len(newOcoOrder.Orders))
+	}
+	for _, newStandingOrder := range newOcoOrder.Orders {
+		if newStandingOrder == nil {
+			return nil, errors.New("No standing order of the OCO order has been provided.")
+		}
+		err = validateNewStandingOrder(newStandingOrder)
+		if err != nil {
+			return nil, err
+		}
+		if newStandingOrder.IsStopOrder() {
+			continue
+		}
+		if newStandingOrder.TimeInForce != "GTC" && newStandingOrder.TimeInForce != "GTD" {
+			return nil, fmt.Errorf("Unsupported time in force %v of the standing order of the OCO order has been provided.", newStandingOrder.TimeInForce)
+		}
+		if newStandingOrder.PostOnly {
+			return nil, errors.New("The limit orders of the OCO order cannot be post-only.")
+		}
+	}
+	if newOcoOrder.Orders[0].Type != newOcoOrder.Orders[1].Type {
+		return nil, errors.New("Both standing orders of the OCO order need to be of the same type.")
+	}
+	return &newOcoOrder, nil
+}
+
+func postOcoOrderHandler(user *User, w http.ResponseWriter, r *http.Request) {
+	newOcoOrder, err := getNewOcoOrderFromRequest(r)
+	if err != nil {
+		log.Printf("Unable to get OCO order from request. Error: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	// the order book session needs to start before the transaction
+	// so that the transaction sees the changes made by the previous sessions
+	ORDER_BOOK.Begin()
+	tx := DB.Begin()
+	// the balances might have changed since the user has been authenticated
+	_, err = getUserFromDb(tx, user)
+	if err != nil {
+		tx.Rollback()
+		ORDER_BOOK.Rollback()
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	// the CreateOcoOrder method commits or rolls back the transaction as necessary
+	standingOrders, err := user.CreateOcoOrder(tx, newOcoOrder)
+	// transaction is no longer in progress here
+	if errors.Is(err, NO_PRICE_AVAILABLE) {
+		log.Printf("No last trade price to derive the trigger price of the trailing stop order of %v from.", newOcoOrder)
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	if err != nil && !errors.Is(err, INSUFFICIENT_BALANCE) {
+		log.Printf("Unable to create OCO order %v. Error: %v", newOcoOrder, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if errors.Is(err, INSUFFICIENT_BALANCE) {
+		log.Printf("Insufficient balance to create OCO order %v. Created as cancelled.", newOcoOrder)
+		w.WriteHeader(http.StatusConflict)
+		// the output will still contain the created standing orders' IDs
+	}
+	standingOrderIds := []StandingOrderId{}
+	for _, standingOrder := range standingOrders {
+		standingOrderIds = append(standingOrderIds, StandingOrderId{ID: standingOrder.ID})
+	}
+	output, err := json.Marshal(standingOrderIds)
+	if err != nil {
+		log.Printf("Unable to serialize StandingOrderId objects to JSON. Error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Write(output)
+}
+
+func ocoOrderHandler(w http.ResponseWriter, r *http.Request) {
+	tx := DB.Begin()
+	user := getAuthenticatedUser(tx, r)
+	if user == nil {
+		tx.Rollback()
+		log.Printf("Unable to get authenticated user.")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case "POST":
+		// the OCO order is created in its own DB transaction
+		// which starts after the order book session
+		tx.Rollback()
+		postOcoOrderHandler(user, w, r)
+	default:
+		tx.Rollback()
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
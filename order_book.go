@@ -0,0 +1,388 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"gorm.io/gorm"
+)
+
+// A group of live standing orders with the same limit price,
+// kept in the order of their sequence numbers,
+// which is the order in which they are supposed to be matched.
+type PriceLevelKey struct {
+	Type  string
+	Price float64
+}
+
+type PriceLevel struct {
+	// limit USD cents price for one Satoshi
+	Price  float64
+	Orders []*StandingOrder
+}
+
+// Get the total quantity in Satoshis of the orders at the price level
+// which is shown in the order book. The hidden parts of the iceberg orders are not included.
+func (level *PriceLevel) Quantity() int64 {
+	var quantity int64 = 0
+	for _, standingOrder := range level.Orders {
+		quantity += standingOrder.GetMatchableQuantity()
+	}
+	return quantity
+}
+
+// The in-memory order book of the live standing orders.
+//
+// The database remains the durable store of the standing orders.
+// The order book only holds copies of the live ones
+// in order to be able to find the best matching order quickly.
+//
+// The changes of the order book are made in sessions
+// which mirror the database transactions:
+// a session is started by Begin and ended by either Commit or Rollback.
+// Only one session can be in progress at a time,
+// which also serializes the matching of the orders.
+type OrderBook struct {
+	mutex sync.Mutex
+	// bids are sorted by their limit price in descending order
+	bids []*PriceLevel
+	// asks are sorted by their limit price in ascending order
+	asks   []*PriceLevel
+	orders map[int64]*StandingOrder
+	// The original copies of the orders that have been modified in the current session.
+	// A nil value means that the order has not been in the book before the session.
+	originals map[int64]*StandingOrder
+	// the trades made in the current session, which are published when it is committed
+	trades []*Trade
+}
+
+var ORDER_BOOK = NewOrderBook()
+
+func NewOrderBook() *OrderBook {
+	return &OrderBook{
+		orders:    map[int64]*StandingOrder{},
+		originals: map[int64]*StandingOrder{},
+	}
+}
+
+// Start a new session of changes.
+// Blocks until the session that is currently in progress, if any, is finished.
+func (book *OrderBook) Begin() {
+	book.mutex.Lock()
+}
+
+// Keep the changes made in the current session and finish it.
+// The trades and the changed price levels are published on the market data feed
+// and the new trades cause the stop orders to be checked.
+func (book *OrderBook) Commit() {
+	for _, trade := range book.trades {
+		MARKET_DATA_FEED.Publish("trades", newPublicTrade(trade))
+	}
+	if len(book.trades) > 0 {
+		signalStopOrders()
+	}
+	for _, update := range book.getChangedLevels() {
+		MARKET_DATA_FEED.Publish("order_book", update)
+	}
+	book.originals = map[int64]*StandingOrder{}
+	book.trades = nil
+	book.mutex.Unlock()
+}
+
+// Record the trade made in the current session.
+// Must only be called within a session.
+func (book *OrderBook) AddTrade(trade *Trade) {
+	book.trades = append(book.trades, trade)
+}
+
+// Get the current state of the price levels which have been changed in the current session.
+func (book *OrderBook) getChangedLevels() []*OrderBookLevelUpdate {
+	var updates []*OrderBookLevelUpdate
+	changed := map[PriceLevelKey]bool{}
+	for id, original := range book.originals {
+		for _, standingOrder := range []*StandingOrder{original, book.orders[id]} {
+			if standingOrder == nil {
+				continue
+			}
+			key := PriceLevelKey{Type: standingOrder.Type, Price: standingOrder.LimitPrice}
+			if changed[key] {
+				continue
+			}
+			changed[key] = true
+			level := book.findLevel(key.Type, key.Price)
+			if level == nil {
+				// the price level has been removed
+				level = &PriceLevel{Price: key.Price}
+			}
+			updates = append(updates, newOrderBookLevelUpdate(key.Type, level))
+		}
+	}
+	return updates
+}
+
+// Get the state of the provided number of the best price levels on each side.
+// If the provided depth is zero, all the price levels are included.
+// Must only be called within a session.
+func (book *OrderBook) snapshot(depth int) *OrderBookSnapshot {
+	snapshot := &OrderBookSnapshot{
+		Bids: []*OrderBookLevelUpdate{},
+		Asks: []*OrderBookLevelUpdate{},
+	}
+	for i, level := range book.bids {
+		if depth != 0 && i >= depth {
+			break
+		}
+		snapshot.Bids = append(snapshot.Bids, newOrderBookLevelUpdate("BUY", level))
+	}
+	for i, level := range book.asks {
+		if depth != 0 && i >= depth {
+			break
+		}
+		snapshot.Asks = append(snapshot.Asks, newOrderBookLevelUpdate("SELL", level))
+	}
+	return snapshot
+}
+
+// Get the state of the provided number of the best price levels on each side.
+// If the provided depth is zero, all the price levels are included.
+func (book *OrderBook) Depth(depth int) *OrderBookSnapshot {
+	book.Begin()
+	defer book.Commit()
+	return book.snapshot(depth)
+}
+
+// Revert the changes made in the current session and finish it.
+func (book *OrderBook) Rollback() {
+	for id, original := range book.originals {
+		book.remove(id)
+		if original != nil {
+			book.insert(original)
+		}
+	}
+	book.originals = map[int64]*StandingOrder{}
+	book.trades = nil
+	book.mutex.Unlock()
+}
+
+// Update the single provided standing order in its own session.
+func (book *OrderBook) Sync(standingOrder *StandingOrder) {
+	book.Begin()
+	book.Update(standingOrder)
+	book.Commit()
+}
+
+// Reflect the current state of the provided standing order in the book.
+// Must only be called within a session.
+func (book *OrderBook) Update(standingOrder *StandingOrder) {
+	current := book.orders[standingOrder.ID]
+	book.recordOriginal(standingOrder.ID)
+	if standingOrder.State != "LIVE" {
+		book.remove(standingOrder.ID)
+		return
+	}
+	copied := *standingOrder
+	// the users are not cached in the book because their balances change all the time
+	copied.User = User{}
+	if current != nil && current.LimitPrice == copied.LimitPrice && current.Sequence == copied.Sequence {
+		// the order keeps its place in the queue
+		*current = copied
+		return
+	}
+	book.remove(standingOrder.ID)
+	book.insert(&copied)
+}
+
+// Take the standing order with the provided ID out of the book without changing it,
+// e.g. because it has nothing left to match.
+// Must only be called within a session.
+func (book *OrderBook) Drop(id int64) {
+	book.recordOriginal(id)
+	book.remove(id)
+}
+
+// Remember the state of the standing order with the provided ID before the current session,
+// unless it has already been changed in the session.
+func (book *OrderBook) recordOriginal(id int64) {
+	if _, recorded := book.originals[id]; recorded {
+		return
+	}
+	var original *StandingOrder
+	if current := book.orders[id]; current != nil {
+		copied := *current
+		original = &copied
+	}
+	book.originals[id] = original
+}
+
+// Get the best live standing order of the provided type,
+// i.e. the one with the best limit price and the lowest sequence number,
+// whose limit price is at least as good as the provided limit price.
+// If the provided limit price is zero, any limit price is acceptable.
+// Must only be called within a session.
+func (book *OrderBook) BestOrder(orderType string, satoshiUsdCentsLimitPrice float64) *StandingOrder {
+	levels := book.asks
+	if orderType == "BUY" {
+		levels = book.bids
+	}
+	if len(levels) == 0 {
+		return nil
+	}
+	level := levels[0]
+	if satoshiUsdCentsLimitPrice != 0 && !isPriceAcceptable(orderType, level.Price, satoshiUsdCentsLimitPrice) {
+		return nil
+	}
+	return level.Orders[0]
+}
+
+// Get the limit price of the best live standing order of the provided type.
+// Returns zero if there is no such order.
+// Must only be called within a session.
+func (book *OrderBook) bestPrice(orderType string) float64 {
+	levels := *book.side(orderType)
+	if len(levels) == 0 {
+		return 0
+	}
+	return levels[0].Price
+}
+
+// Get the best bid and ask limit prices in USD cents for one Satoshi.
+// The price of the side without any live standing orders is zero.
+func (book *OrderBook) BestPrices() (satoshiUsdCentsBidPrice float64, satoshiUsdCentsAskPrice float64) {
+	book.Begin()
+	defer book.Commit()
+	return book.bestPrice("BUY"), book.bestPrice("SELL")
+}
+
+// Check whether the limit price of a standing order of the provided type
+// satisfies the limit price of the opposite order.
+func isPriceAcceptable(orderType string, satoshiUsdCentsPrice float64, satoshiUsdCentsLimitPrice float64) bool {
+	if orderType == "BUY" {
+		return satoshiUsdCentsPrice >= satoshiUsdCentsLimitPrice
+	}
+	return satoshiUsdCentsPrice <= satoshiUsdCentsLimitPrice
+}
+
+// Load all the live standing orders from the database into the book.
+func (book *OrderBook) Load(tx *gorm.DB) error {
+	var standingOrders []*StandingOrder
+	// the immediate orders never rest in the order book
+	result := tx.Where(&StandingOrder{State: "LIVE"}).Where("time_in_force NOT IN ?", []string{"IOC", "FOK"}).Order("sequence asc").Find(&standingOrders)
+	if err := result.Error; err != nil {
+		log.Printf("Unable to get the live standing orders. Error: %v", err)
+		return err
+	}
+	book.Begin()
+	for _, standingOrder := range standingOrders {
+		book.Update(standingOrder)
+	}
+	book.Commit()
+	log.Printf("Loaded %v live standing orders into the order book.", len(standingOrders))
+	return nil
+}
+
+func (book *OrderBook) side(orderType string) *[]*PriceLevel {
+	if orderType == "BUY" {
+		return &book.bids
+	}
+	return &book.asks
+}
+
+// Find the index of the price level with the provided price
+// or the index at which such a price level should be inserted.
+func findPriceLevel(levels []*PriceLevel, orderType string, satoshiUsdCentsPrice float64) int {
+	return sort.Search(len(levels), func(i int) bool {
+		if orderType == "BUY" {
+			return levels[i].Price <= satoshiUsdCentsPrice
+		}
+		return levels[i].Price >= satoshiUsdCentsPrice
+	})
+}
+
+// Get the price level of the provided type with the provided price, if it exists.
+func (book *OrderBook) findLevel(orderType string, satoshiUsdCentsPrice float64) *PriceLevel {
+	levels := *book.side(orderType)
+	i := findPriceLevel(levels, orderType, satoshiUsdCentsPrice)
+	if i == len(levels) || levels[i].Price != satoshiUsdCentsPrice {
+		return nil
+	}
+	return levels[i]
+}
+
+func (book *OrderBook) insert(standingOrder *StandingOrder) {
+	levels := book.side(standingOrder.Type)
+	i := findPriceLevel(*levels, standingOrder.Type, standingOrder.LimitPrice)
+	if i == len(*levels) || (*levels)[i].Price != standingOrder.LimitPrice {
+		*levels = append(*levels, nil)
+		copy((*levels)[i+1:], (*levels)[i:])
+		(*levels)[i] = &PriceLevel{Price: standingOrder.LimitPrice}
+	}
+	level := (*levels)[i]
+	j := sort.Search(len(level.Orders), func(j int) bool {
+		return level.Orders[j].Sequence > standingOrder.Sequence
+	})
+	level.Orders = append(level.Orders, nil)
+	copy(level.Orders[j+1:], level.Orders[j:])
+	level.Orders[j] = standingOrder
+	book.orders[standingOrder.ID] = standingOrder
+}
+
+func (book *OrderBook) remove(id int64) {
+	standingOrder := book.orders[id]
+	if standingOrder == nil {
+		return
+	}
+	delete(book.orders, id)
+	levels := book.side(standingOrder.Type)
+	i := findPriceLevel(*levels, standingOrder.Type, standingOrder.LimitPrice)
+	if i == len(*levels) || (*levels)[i].Price != standingOrder.LimitPrice {
+		log.Printf("Standing order %v is missing from its price level in the order book.", standingOrder)
+		return
+	}
+	level := (*levels)[i]
+	for j, levelOrder := range level.Orders {
+		if levelOrder == standingOrder {
+			level.Orders = append(level.Orders[:j], level.Orders[j+1:]...)
+			break
+		}
+	}
+	if len(level.Orders) == 0 {
+		*levels = append((*levels)[:i], (*levels)[i+1:]...)
+	}
+}
+
+const DEFAULT_ORDER_BOOK_DEPTH = 10
+
+func getOrderBookHandler(w http.ResponseWriter, r *http.Request) {
+	depth := DEFAULT_ORDER_BOOK_DEPTH
+	if value := r.URL.Query().Get("depth"); value != "" {
+		var err error
+		depth, err = strconv.Atoi(value)
+		if err != nil || depth <= 0 {
+			log.Printf("Invalid order book depth %v has been provided. Error: %v", value, err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	snapshot := ORDER_BOOK.Depth(depth)
+	output, err := json.Marshal(snapshot)
+	if err != nil {
+		log.Printf("Unable to serialize OrderBookSnapshot object to JSON. Error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Write(output)
+}
+
+// The order book is public, so no authentication is required.
+func orderBookHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		getOrderBookHandler(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
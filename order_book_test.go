@@ -0,0 +1,166 @@
+package main
+
+import (
+	"testing"
+)
+
+// Get a new order book containing the provided live standing orders.
+func newTestOrderBook(standingOrders ...*StandingOrder) *OrderBook {
+	book := NewOrderBook()
+	book.Begin()
+	for _, standingOrder := range standingOrders {
+		book.Update(standingOrder)
+	}
+	book.Commit()
+	return book
+}
+
+// Get the IDs of the standing orders of the provided type in the order in which they would be matched.
+func getOrderBookIds(book *OrderBook, orderType string) []int64 {
+	var ids []int64
+	for _, level := range *book.side(orderType) {
+		for _, standingOrder := range level.Orders {
+			ids = append(ids, standingOrder.ID)
+		}
+	}
+	return ids
+}
+
+func equalIds(a []int64, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestOrderBookPriority(t *testing.T) {
+	book := newTestOrderBook(
+		&StandingOrder{ID: 1, Type: "BUY", State: "LIVE", LimitPrice: 0.05, Sequence: 1, RemainingQuantity: 100},
+		&StandingOrder{ID: 2, Type: "BUY", State: "LIVE", LimitPrice: 0.06, Sequence: 2, RemainingQuantity: 100},
+		&StandingOrder{ID: 3, Type: "BUY", State: "LIVE", LimitPrice: 0.05, Sequence: 3, RemainingQuantity: 100},
+		&StandingOrder{ID: 4, Type: "SELL", State: "LIVE", LimitPrice: 0.08, Sequence: 5, RemainingQuantity: 100},
+		&StandingOrder{ID: 5, Type: "SELL", State: "LIVE", LimitPrice: 0.07, Sequence: 6, RemainingQuantity: 100},
+		&StandingOrder{ID: 6, Type: "SELL", State: "LIVE", LimitPrice: 0.08, Sequence: 4, RemainingQuantity: 100},
+	)
+	tests := []struct {
+		orderType string
+		ids       []int64
+	}{
+		// the best price first, then the lowest sequence number
+		{"BUY", []int64{2, 1, 3}},
+		{"SELL", []int64{5, 6, 4}},
+	}
+	for _, test := range tests {
+		ids := getOrderBookIds(book, test.orderType)
+		if !equalIds(ids, test.ids) {
+			t.Errorf("The %v orders are %v, expected %v.", test.orderType, ids, test.ids)
+		}
+	}
+}
+
+func TestOrderBookBestOrder(t *testing.T) {
+	book := newTestOrderBook(
+		&StandingOrder{ID: 1, Type: "BUY", State: "LIVE", LimitPrice: 0.05, Sequence: 1, RemainingQuantity: 100},
+		&StandingOrder{ID: 2, Type: "BUY", State: "LIVE", LimitPrice: 0.06, Sequence: 2, RemainingQuantity: 100},
+		&StandingOrder{ID: 3, Type: "SELL", State: "LIVE", LimitPrice: 0.07, Sequence: 3, RemainingQuantity: 100},
+	)
+	tests := []struct {
+		orderType  string
+		limitPrice float64
+		// zero if no order is expected
+		id int64
+	}{
+		{"BUY", 0, 2},
+		{"BUY", 0.06, 2},
+		{"BUY", 0.055, 2},
+		{"BUY", 0.061, 0},
+		{"SELL", 0, 3},
+		{"SELL", 0.07, 3},
+		{"SELL", 0.069, 0},
+	}
+	book.Begin()
+	defer book.Commit()
+	for _, test := range tests {
+		standingOrder := book.BestOrder(test.orderType, test.limitPrice)
+		var id int64 = 0
+		if standingOrder != nil {
+			id = standingOrder.ID
+		}
+		if id != test.id {
+			t.Errorf("The best %v order with limit price %v is %v, expected %v.", test.orderType, test.limitPrice, id, test.id)
+		}
+	}
+}
+
+func TestOrderBookUpdate(t *testing.T) {
+	tests := []struct {
+		name   string
+		update *StandingOrder
+		ids    []int64
+	}{
+		{"new order", &StandingOrder{ID: 4, Type: "SELL", State: "LIVE", LimitPrice: 0.07, Sequence: 4}, []int64{1, 2, 4, 3}},
+		{"filled order", &StandingOrder{ID: 1, Type: "SELL", State: "FULFILLED", LimitPrice: 0.07, Sequence: 1}, []int64{2, 3}},
+		{"last order at the price", &StandingOrder{ID: 3, Type: "SELL", State: "CANCELLED", LimitPrice: 0.08, Sequence: 3}, []int64{1, 2}},
+		{"partially filled order", &StandingOrder{ID: 1, Type: "SELL", State: "LIVE", LimitPrice: 0.07, Sequence: 1, RemainingQuantity: 50}, []int64{1, 2, 3}},
+		{"replenished order", &StandingOrder{ID: 1, Type: "SELL", State: "LIVE", LimitPrice: 0.07, Sequence: 5}, []int64{2, 1, 3}},
+		{"repriced order", &StandingOrder{ID: 3, Type: "SELL", State: "LIVE", LimitPrice: 0.06, Sequence: 5}, []int64{3, 1, 2}},
+	}
+	for _, test := range tests {
+		book := newTestOrderBook(
+			&StandingOrder{ID: 1, Type: "SELL", State: "LIVE", LimitPrice: 0.07, Sequence: 1, RemainingQuantity: 100},
+			&StandingOrder{ID: 2, Type: "SELL", State: "LIVE", LimitPrice: 0.07, Sequence: 2, RemainingQuantity: 100},
+			&StandingOrder{ID: 3, Type: "SELL", State: "LIVE", LimitPrice: 0.08, Sequence: 3, RemainingQuantity: 100},
+		)
+		book.Begin()
+		book.Update(test.update)
+		book.Commit()
+		ids := getOrderBookIds(book, "SELL")
+		if !equalIds(ids, test.ids) {
+			t.Errorf("%v: The orders are %v, expected %v.", test.name, ids, test.ids)
+		}
+	}
+}
+
+func TestOrderBookRollback(t *testing.T) {
+	tests := []struct {
+		name    string
+		updates []*StandingOrder
+		drops   []int64
+	}{
+		{"new order", []*StandingOrder{{ID: 4, Type: "SELL", State: "LIVE", LimitPrice: 0.06, Sequence: 4}}, nil},
+		{"filled order", []*StandingOrder{{ID: 1, Type: "SELL", State: "FULFILLED", LimitPrice: 0.07, Sequence: 1}}, nil},
+		{"replenished order", []*StandingOrder{{ID: 1, Type: "SELL", State: "LIVE", LimitPrice: 0.07, Sequence: 5}}, nil},
+		{"order changed twice", []*StandingOrder{
+			{ID: 2, Type: "SELL", State: "LIVE", LimitPrice: 0.07, Sequence: 2, RemainingQuantity: 50},
+			{ID: 2, Type: "SELL", State: "FULFILLED", LimitPrice: 0.07, Sequence: 2},
+		}, nil},
+		{"dropped order", nil, []int64{3}},
+	}
+	for _, test := range tests {
+		book := newTestOrderBook(
+			&StandingOrder{ID: 1, Type: "SELL", State: "LIVE", LimitPrice: 0.07, Sequence: 1, RemainingQuantity: 100},
+			&StandingOrder{ID: 2, Type: "SELL", State: "LIVE", LimitPrice: 0.07, Sequence: 2, RemainingQuantity: 100},
+			&StandingOrder{ID: 3, Type: "SELL", State: "LIVE", LimitPrice: 0.08, Sequence: 3, RemainingQuantity: 100},
+		)
+		book.Begin()
+		for _, update := range test.updates {
+			book.Update(update)
+		}
+		for _, id := range test.drops {
+			book.Drop(id)
+		}
+		book.Rollback()
+		ids := getOrderBookIds(book, "SELL")
+		if !equalIds(ids, []int64{1, 2, 3}) {
+			t.Errorf("%v: The orders are %v after the rollback, expected the original ones.", test.name, ids)
+		}
+		if book.orders[2].RemainingQuantity != 100 {
+			t.Errorf("%v: The remaining quantity of order 2 is %v after the rollback, expected 100.", test.name, book.orders[2].RemainingQuantity)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const EXPIRY_SWEEP_INTERVAL = time.Second
+const EXPIRY_BATCH_SIZE = 100
+
+// Whether the standing order is a GTD order whose expiry time has passed.
+func (standingOrder *StandingOrder) IsExpired() bool {
+	return standingOrder.ExpiresAt != nil && !standingOrder.ExpiresAt.After(time.Now())
+}
+
+// Set status of the standing order to expired within the provided transaction.
+// The caller is responsible for updating the order book.
+func (standingOrder *StandingOrder) Expire(tx *gorm.DB) error {
+	standingOrder.State = "EXPIRED"
+	result := tx.Save(standingOrder)
+	if err := result.Error; err != nil {
+		log.Printf("Unable to save the standing order %v. Error: %v", standingOrder, err)
+		return err
+	}
+	return standingOrder.EnqueueWebhook(tx, "ORDER_EXPIRED")
+}
+
+// Expire the live standing orders and the untriggered stop orders whose expiry time has passed.
+func expireStandingOrders() error {
+	ORDER_BOOK.Begin()
+	tx := DB.Begin()
+	var standingOrders []*StandingOrder
+	result := tx.Where("state IN ?", []string{"LIVE", "UNTRIGGERED"}).Where("expires_at <= ?", time.Now()).Order("id asc").Limit(EXPIRY_BATCH_SIZE).Find(&standingOrders)
+	if err := result.Error; err != nil {
+		tx.Rollback()
+		ORDER_BOOK.Rollback()
+		log.Printf("Unable to get the expired standing orders. Error: %v", err)
+		return err
+	}
+	if len(standingOrders) == 0 {
+		tx.Rollback()
+		ORDER_BOOK.Rollback()
+		return nil
+	}
+	for _, standingOrder := range standingOrders {
+		err := standingOrder.Expire(tx)
+		if err != nil {
+			tx.Rollback()
+			ORDER_BOOK.Rollback()
+			return err
+		}
+		ORDER_BOOK.Update(standingOrder)
+	}
+	result = tx.Commit()
+	if err := result.Error; err != nil {
+		tx.Rollback()
+		ORDER_BOOK.Rollback()
+		log.Printf("Unable to commit the transaction. Error: %v", result.Error)
+		return err
+	}
+	ORDER_BOOK.Commit()
+	log.Printf("Expired %v standing orders.", len(standingOrders))
+	return nil
+}
+
+// Cancel the live IOC and FOK standing orders,
+// whose execution has been interrupted by the previous shutdown of the exchange.
+// Must be called on startup before the standing orders are executed.
+func cancelInterruptedImmediateOrders() error {
+	tx := DB.Begin()
+	var standingOrders []*StandingOrder
+	result := tx.Where(&StandingOrder{State: "LIVE"}).Where("time_in_force IN ?", []string{"IOC", "FOK"}).Find(&standingOrders)
+	if err := result.Error; err != nil {
+		tx.Rollback()
+		log.Printf("Unable to get the live immediate standing orders. Error: %v", err)
+		return err
+	}
+	for _, standingOrder := range standingOrders {
+		standingOrder.State = "CANCELLED"
+		result = tx.Save(standingOrder)
+		if err := result.Error; err != nil {
+			tx.Rollback()
+			log.Printf("Unable to save the standing order %v. Error: %v", standingOrder, err)
+			return err
+		}
+		err := standingOrder.EnqueueWebhook(tx, "ORDER_CANCELLED")
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	result = tx.Commit()
+	if err := result.Error; err != nil {
+		tx.Rollback()
+		log.Printf("Unable to commit the transaction. Error: %v", result.Error)
+		return err
+	}
+	log.Printf("Cancelled %v interrupted immediate standing orders.", len(standingOrders))
+	return nil
+}
+
+// Keep expiring the standing orders in the background.
+func startExpirySweeper() {
+	log.Printf("Starting the standing order expiry sweeper.")
+	go func() {
+		for {
+			expireStandingOrders()
+			time.Sleep(EXPIRY_SWEEP_INTERVAL)
+		}
+	}()
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The USD price for one BTC as observed by a price oracle.
+type PriceQuote struct {
+	Price float64
+	// the name of the source from which the price has been obtained
+	Source     string
+	ObservedAt time.Time
+	// whether the price is a last known price that could not have been refreshed
+	Stale bool
+}
+
+// A source of the USD price for one BTC.
+type PriceOracle interface {
+	GetBitcoinUSDPrice() (*PriceQuote, error)
+}
+
+var PRICE_ORACLE PriceOracle
+
+// The price oracles which can be used for the valuation of the balances, by their names,
+// and the name of the one used when the request does not specify any.
+var VALUATION_ORACLES map[string]PriceOracle
+var DEFAULT_VALUATION string
+
+var NO_PRICE_AVAILABLE = errors.New("No price available.")
+
+var PRICE_ORACLE_HTTP_CLIENT = &http.Client{Timeout: 5 * time.Second}
+
+type CoinbasePrice struct {
+	Base     string
+	Currency string
+	Amount   string
+}
+
+type CoinbaseResponse struct {
+	Data CoinbasePrice
+}
+
+// The spot price provided by Coinbase.
+type CoinbasePriceOracle struct{}
+
+func (oracle *CoinbasePriceOracle) GetBitcoinUSDPrice() (*PriceQuote, error) {
+	response, err := PRICE_ORACLE_HTTP_CLIENT.Get("https://api.coinbase.com/v2/prices/spot?currency=USD")
+	if err != nil {
+		log.Printf("Unable to get Bitcoin price in USD. Error: %v", err)
+		return nil, err
+	}
+	defer response.Body.Close()
+	var responseData CoinbaseResponse
+	decoder := json.NewDecoder(response.Body)
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&responseData)
+	if err != nil {
+		log.Printf("Unable to decode CoinbaseResponse from JSON. Error: %v", err)
+		return nil, err
+	}
+	value, err := strconv.ParseFloat(responseData.Data.Amount, 64)
+	if err != nil {
+		log.Printf("Unable to convert provided string to float64. Error: %v", err)
+		return nil, err
+	}
+	return &PriceQuote{Price: value, Source: "coinbase", ObservedAt: time.Now()}, nil
+}
+
+// A stub that reads the price from a local file or from an HTTP URL,
+// whose content is expected to be just the decimal number.
+// Useful for running the exchange offline.
+type StubPriceOracle struct {
+	// a file path or an HTTP URL
+	Location string
+}
+
+func (oracle *StubPriceOracle) GetBitcoinUSDPrice() (*PriceQuote, error) {
+	var content []byte
+	var err error
+	if strings.HasPrefix(oracle.Location, "http://") || strings.HasPrefix(oracle.Location, "https://") {
+		var response *http.Response
+		response, err = PRICE_ORACLE_HTTP_CLIENT.Get(oracle.Location)
+		if err != nil {
+			log.Printf("Unable to get Bitcoin price in USD from %v. Error: %v", oracle.Location, err)
+			return nil, err
+		}
+		defer response.Body.Close()
+		content, err = ioutil.ReadAll(response.Body)
+	} else {
+		content, err = ioutil.ReadFile(oracle.Location)
+	}
+	if err != nil {
+		log.Printf("Unable to read Bitcoin price in USD from %v. Error: %v", oracle.Location, err)
+		return nil, err
+	}
+	value, err := strconv.ParseFloat(strings.TrimSpace(string(content)), 64)
+	if err != nil {
+		log.Printf("Unable to convert provided string to float64. Error: %v", err)
+		return nil, err
+	}
+	return &PriceQuote{Price: value, Source: oracle.Location, ObservedAt: time.Now()}, nil
+}
+
+// Tries the provided oracles in order until one of them provides the price.
+type FallbackPriceOracle struct {
+	Oracles []PriceOracle
+}
+
+func (oracle *FallbackPriceOracle) GetBitcoinUSDPrice() (*PriceQuote, error) {
+	for _, fallback := range oracle.Oracles {
+		quote, err := fallback.GetBitcoinUSDPrice()
+		if err == nil {
+			return quote, nil
+		}
+		log.Printf("Unable to get Bitcoin price in USD from oracle %T. Error: %v", fallback, err)
+	}
+	return nil, NO_PRICE_AVAILABLE
+}
+
+// Keeps the price provided by the underlying oracle for the time to live.
+// If the underlying oracle fails, the last known price is provided
+// and marked as stale.
+type CachingPriceOracle struct {
+	Oracle PriceOracle
+	TTL    time.Duration
+	mutex  sync.Mutex
+	last   *PriceQuote
+}
+
+func (oracle *CachingPriceOracle) GetBitcoinUSDPrice() (*PriceQuote, error) {
+	oracle.mutex.Lock()
+	defer oracle.mutex.Unlock()
+	if oracle.last != nil && time.Since(oracle.last.ObservedAt) < oracle.TTL {
+		quote := *oracle.last
+		return &quote, nil
+	}
+	quote, err := oracle.Oracle.GetBitcoinUSDPrice()
+	if err != nil {
+		if oracle.last == nil {
+			return nil, err
+		}
+		log.Printf("Using the last known Bitcoin price in USD %v. Error: %v", oracle.last, err)
+		stale := *oracle.last
+		stale.Stale = true
+		return &stale, nil
+	}
+	oracle.last = quote
+	copied := *quote
+	return &copied, nil
+}
+
+// Create the price oracle from the provided comma-separated list of sources,
+// which are tried in the provided order.
+// The source "coinbase" denotes the Coinbase spot price,
+// any other source is considered to be a location of the stub price.
+func newPriceOracle(sources string, ttl time.Duration) (PriceOracle, error) {
+	var oracles []PriceOracle
+	for _, source := range strings.Split(sources, ",") {
+		source = strings.TrimSpace(source)
+		switch source {
+		case "":
+			continue
+		case "coinbase":
+			oracles = append(oracles, &CoinbasePriceOracle{})
+		default:
+			oracles = append(oracles, &StubPriceOracle{Location: source})
+		}
+	}
+	if len(oracles) == 0 {
+		return nil, fmt.Errorf("No price sources have been provided in %q.", sources)
+	}
+	return &CachingPriceOracle{
+		Oracle: &FallbackPriceOracle{Oracles: oracles},
+		TTL:    ttl,
+	}, nil
+}
+
+// The price of the most recent trade on this exchange.
+type LastTradePriceOracle struct{}
+
+func (oracle *LastTradePriceOracle) GetBitcoinUSDPrice() (*PriceQuote, error) {
+	trade, err := getLastTrade(DB)
+	if err != nil {
+		return nil, err
+	}
+	return &PriceQuote{Price: trade.Price * 1000000, Source: "last_trade", ObservedAt: trade.CreatedAt}, nil
+}
+
+// The highest limit price of the live standing orders to buy on this exchange.
+type BestBidPriceOracle struct{}
+
+func (oracle *BestBidPriceOracle) GetBitcoinUSDPrice() (*PriceQuote, error) {
+	bidPrice, _ := ORDER_BOOK.BestPrices()
+	if bidPrice == 0 {
+		return nil, NO_PRICE_AVAILABLE
+	}
+	return &PriceQuote{Price: bidPrice * 1000000, Source: "best_bid", ObservedAt: time.Now()}, nil
+}
+
+// The price in the middle between the best bid and the best ask on this exchange.
+type MidPriceOracle struct{}
+
+func (oracle *MidPriceOracle) GetBitcoinUSDPrice() (*PriceQuote, error) {
+	bidPrice, askPrice := ORDER_BOOK.BestPrices()
+	if bidPrice == 0 || askPrice == 0 {
+		return nil, NO_PRICE_AVAILABLE
+	}
+	return &PriceQuote{Price: (bidPrice + askPrice) / 2 * 1000000, Source: "mid", ObservedAt: time.Now()}, nil
+}
+
+// Get the price oracles which can be used for the valuation of the balances, by their names.
+// The name "oracle" denotes the provided external price oracle.
+func getValuationOracles(externalOracle PriceOracle) map[string]PriceOracle {
+	return map[string]PriceOracle{
+		"oracle":     externalOracle,
+		"last_trade": &LastTradePriceOracle{},
+		"best_bid":   &BestBidPriceOracle{},
+		"mid":        &MidPriceOracle{},
+	}
+}
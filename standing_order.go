@@ -1,14 +1,15 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"html"
 	"log"
+	"math"
 	"net/http"
 	"strconv"
+	"time"
 
 	"gorm.io/gorm"
 )
@@ -28,9 +29,47 @@ type StandingOrder struct {
 	// fulfilled quantity is represented in Satoshis
 	FulfilledQuantity int64 `json:"fulfilled_quantity" gorm:"default:0; not null"`
 	// remaining quantity is represented in Satoshis
-	RemainingQuantity int64  `json:"remaining_quantity" gorm:"not null"`
-	WebhookURL        string `json:"webhook_url"`
-	User              User   `json:"-"`
+	RemainingQuantity int64     `json:"remaining_quantity" gorm:"not null"`
+	WebhookURL        string    `json:"webhook_url"`
+	User              User      `json:"-"`
+	CreatedAt         time.Time `json:"created_at"`
+	// Monotonically increasing sequence number of the order.
+	// Among the orders with the same limit price,
+	// the ones with lower sequence numbers are matched first.
+	Sequence int64 `json:"sequence" gorm:"autoIncrement; not null; uniqueIndex"`
+	// GTC (good-till-cancelled), IOC (immediate-or-cancel),
+	// FOK (fill-or-kill) or GTD (good-till-date)
+	TimeInForce string `json:"time_in_force" gorm:"default:GTC; not null"`
+	// the time at which a GTD order expires, null for the other orders
+	ExpiresAt *time.Time `json:"expires_at" gorm:"index"`
+	// whether the order may only rest in the order book and never match on arrival
+	PostOnly bool `json:"post_only" gorm:"default:false; not null"`
+	// Last trade USD cents price for one Satoshi at which a stop order is triggered,
+	// zero for the other orders.
+	// A stop order to buy is triggered when the last trade price rises to the trigger price or above it,
+	// a stop order to sell when it falls to the trigger price or below it.
+	TriggerPrice float64 `json:"trigger_price" gorm:"default:0; not null"`
+	// the ID of the standing order created by a triggered stop-limit order
+	TriggeredOrderId int64 `json:"triggered_order_id"`
+	// The ID of the last trade against which the untriggered stop order has been checked
+	// and which the trigger price of a trailing stop order has followed,
+	// initially the last trade made before its placement.
+	CheckedTradeId int64 `json:"-" gorm:"default:0; not null"`
+	// The distance of the trigger price of a trailing stop order
+	// from the best last trade price seen since its creation,
+	// either in USD cents for one Satoshi or in percent of the price.
+	// The trigger price of a trailing stop order to sell only rises
+	// and the trigger price of a trailing stop order to buy only falls.
+	TrailAmount  float64 `json:"trail_amount" gorm:"default:0; not null"`
+	TrailPercent float64 `json:"trail_percent" gorm:"default:0; not null"`
+	// the ID of the other order of an OCO pair, zero for the other orders
+	LinkedOrderId int64 `json:"linked_order_id" gorm:"default:0; not null"`
+	// The quantity in Satoshis shown in the order book at once by an iceberg order,
+	// zero for the other orders.
+	// The remaining quantity of an iceberg order is still blocked in full.
+	DisplayQuantity int64 `json:"display_quantity" gorm:"default:0; not null"`
+	// the currently shown part of the remaining quantity of an iceberg order in Satoshis
+	VisibleQuantity int64 `json:"visible_quantity" gorm:"default:0; not null"`
 }
 
 // A new standing order to buy or sell BTC.
@@ -41,14 +80,73 @@ type NewStandingOrder struct {
 	// limit USD price for one BTC
 	LimitPrice float64 `json:"limit_price"`
 	WebhookURL string  `json:"webhook_url"`
+	// GTC if not provided
+	TimeInForce string `json:"time_in_force"`
+	// required for the GTD orders only
+	ExpiresAt *time.Time `json:"expires_at"`
+	PostOnly  bool       `json:"post_only"`
+	// Whether a post-only order which would match on arrival
+	// should be repriced one tick away from the best opposite price instead of being rejected.
+	Reprice bool
+	// Last trade USD price for one BTC at which the order is triggered.
+	// If provided, the order is a stop order which stays dormant until it is triggered.
+	// A stop order without the limit price is performed as a market order.
+	TriggerPrice float64 `json:"trigger_price"`
+	// The distance in USD for one BTC or in percent of the trigger price of a trailing stop order
+	// from the best last trade price. At most one of them can be provided.
+	// The trigger price of a trailing stop order is optional
+	// and defaults to the one derived from the last trade price.
+	TrailAmount  float64 `json:"trail_amount"`
+	TrailPercent float64 `json:"trail_percent"`
+	// The quantity in BTC shown in the order book at once.
+	// If provided, the order is an iceberg order whose shown part
+	// is replenished from the hidden remainder after it has been filled.
+	DisplayQuantity float64 `json:"display_quantity"`
 }
 
+// Whether the new standing order is a stop order, including a trailing one.
+func (newStandingOrder *NewStandingOrder) IsStopOrder() bool {
+	return newStandingOrder.TriggerPrice != 0 || newStandingOrder.TrailAmount != 0 || newStandingOrder.TrailPercent != 0
+}
+
+var TIME_IN_FORCE_OPTIONS = map[string]bool{"GTC": true, "IOC": true, "FOK": true, "GTD": true}
+
 type StandingOrderId struct {
 	ID int64
 }
 
+// The changes of a live standing order.
+// The fields which are not provided are left unchanged.
+type StandingOrderAmendment struct {
+	// new remaining quantity in BTC
+	Quantity *float64
+	// new limit USD price for one BTC
+	LimitPrice *float64 `json:"limit_price"`
+}
+
 var PERMISSION_DENIED = errors.New("Permission denied.")
 var INSUFFICIENT_BALANCE = errors.New("Insufficient balance.")
+var ORDER_NOT_LIVE = errors.New("Standing order is not live.")
+var POST_ONLY_WOULD_MATCH = errors.New("Post-only standing order would match on arrival.")
+
+// The smallest difference between two limit prices in USD cents for one BTC.
+const PRICE_TICK = 1
+
+// Get the USD cents price for one Satoshi which is the provided number of ticks away from the provided one.
+// It is computed in whole USD cents for one BTC and converted in the same way as the limit prices
+// of the new standing orders, so that it equals the limit price of the orders entered at the same USD price.
+func getPriceTicksAway(satoshiUsdCentsPrice float64, ticks int64) float64 {
+	btcUsdCentsPrice := int64(math.Round(satoshiUsdCentsPrice*100000000)) + ticks*PRICE_TICK
+	return float64(btcUsdCentsPrice) / 100 / 1000000
+}
+
+// Get the type of the standing orders which can match the standing order of the provided type.
+func getOppositeOrderType(orderType string) string {
+	if orderType == "BUY" {
+		return "SELL"
+	}
+	return "BUY"
+}
 
 func getStandingOrderFromDb(tx *gorm.DB, id int64) (*StandingOrder, error) {
 	standingOrder := &StandingOrder{}
@@ -61,49 +159,186 @@ func getStandingOrderFromDb(tx *gorm.DB, id int64) (*StandingOrder, error) {
 	return standingOrder, nil
 }
 
-func (standingOrder *StandingOrder) PerformWebhookRequest() {
-	if standingOrder.WebhookURL == "" {
-		return
-	}
-	log.Printf("Performing a webhook request for standing order %v to URL %v.", standingOrder.ID, standingOrder.WebhookURL)
-	buffer := bytes.NewBufferString(fmt.Sprint(standingOrder.ID))
-	response, err := http.Post(standingOrder.WebhookURL, "text/plain", buffer)
-	if err != nil {
-		log.Printf("Unable to perform a webhook of standing order with ID %v", standingOrder.ID)
-	}
-	response.Body.Close()
-}
-
 // Set status of the user's standing order with the provided ID to cancelled.
+// Only the live standing orders and the untriggered stop orders can be cancelled.
+// The other order of an OCO pair is cancelled as well.
 func (user *User) DeleteStandingOrder(id int64) error {
+	ORDER_BOOK.Begin()
 	tx := DB.Begin()
 	standingOrder, err := getStandingOrderFromDb(tx, id)
 	if err != nil {
 		// nothing to commit
 		tx.Rollback()
+		ORDER_BOOK.Rollback()
 		return err
 	}
 	if standingOrder.UserId != user.ID {
 		tx.Rollback()
+		ORDER_BOOK.Rollback()
 		return PERMISSION_DENIED
 	}
+	if standingOrder.State != "LIVE" && standingOrder.State != "UNTRIGGERED" {
+		tx.Rollback()
+		ORDER_BOOK.Rollback()
+		return ORDER_NOT_LIVE
+	}
 	standingOrder.State = "CANCELLED"
 	result := tx.Save(standingOrder)
 	if err := result.Error; err != nil {
 		tx.Rollback()
+		ORDER_BOOK.Rollback()
 		log.Printf("Unable to save the standing order %v. Error: %v", standingOrder, err)
 		return err
 	}
+	err = standingOrder.EnqueueWebhook(tx, "ORDER_CANCELLED")
+	if err != nil {
+		tx.Rollback()
+		ORDER_BOOK.Rollback()
+		return err
+	}
+	ORDER_BOOK.Update(standingOrder)
+	_, err = standingOrder.CancelLinkedOrder(tx)
+	if err != nil {
+		tx.Rollback()
+		ORDER_BOOK.Rollback()
+		return err
+	}
 	result = tx.Commit()
 	if err := result.Error; err != nil {
 		tx.Rollback()
+		ORDER_BOOK.Rollback()
 		log.Printf("Unable to commit the transaction. Error: %v", result.Error)
 		return err
 	}
-	standingOrder.PerformWebhookRequest()
+	ORDER_BOOK.Commit()
 	return nil
 }
 
+// Get the next value of the sequence which orders the standing orders with the same limit price.
+func getNextStandingOrderSequence(tx *gorm.DB) (int64, error) {
+	var sequence int64
+	result := tx.Raw("SELECT nextval(pg_get_serial_sequence('standing_orders', 'sequence'))").Scan(&sequence)
+	if err := result.Error; err != nil {
+		log.Printf("Unable to get the next standing order sequence number. Error: %v", err)
+		return 0, err
+	}
+	return sequence, nil
+}
+
+// Change the limit price and/or the remaining quantity of the user's live standing order with the provided ID.
+// The order loses its time priority if its limit price changes or its quantity increases,
+// but keeps it if its quantity decreases.
+// If the order's limit price has changed, try to execute it against the other standing orders.
+// The amendment of a post-only order is rejected if the order would match at its new limit price.
+func (user *User) AmendStandingOrder(id int64, amendment *StandingOrderAmendment) (*StandingOrder, error) {
+	ORDER_BOOK.Begin()
+	tx := DB.Begin()
+	standingOrder, err := getStandingOrderFromDb(tx, id)
+	if err != nil {
+		tx.Rollback()
+		ORDER_BOOK.Rollback()
+		return nil, err
+	}
+	if standingOrder.UserId != user.ID {
+		tx.Rollback()
+		ORDER_BOOK.Rollback()
+		return nil, PERMISSION_DENIED
+	}
+	if standingOrder.State != "LIVE" {
+		tx.Rollback()
+		ORDER_BOOK.Rollback()
+		return nil, ORDER_NOT_LIVE
+	}
+	_, err = getUserFromDb(tx, user)
+	if err != nil {
+		tx.Rollback()
+		ORDER_BOOK.Rollback()
+		return nil, err
+	}
+	satoshiAmount := standingOrder.RemainingQuantity
+	if amendment.Quantity != nil {
+		satoshiAmount = int64(*amendment.Quantity * 100000000)
+	}
+	limitUsdCentsSatoshiPrice := standingOrder.LimitPrice
+	if amendment.LimitPrice != nil {
+		limitUsdCentsSatoshiPrice = *amendment.LimitPrice / 1000000
+	}
+	// The balance blocked by the amended order itself is available for its new version.
+	amendedStandingOrder := *standingOrder
+	amendedStandingOrder.LimitPrice = limitUsdCentsSatoshiPrice
+	amendedStandingOrder.RemainingQuantity = satoshiAmount
+	blockedAmount, err := user.getBlockedAmount(tx, standingOrder.Type, &amendedStandingOrder)
+	if err != nil {
+		tx.Rollback()
+		ORDER_BOOK.Rollback()
+		log.Printf("Unable to determine the blocked amount of user with ID %v. Error: %v", user.ID, err)
+		return nil, err
+	}
+	if standingOrder.Type == "BUY" && blockedAmount > user.USDCentsBalance {
+		tx.Rollback()
+		ORDER_BOOK.Rollback()
+		log.Printf("User with ID %v only has %v USD balance but the live standing orders including the amendment %v of the standing order %v would block %v USD. Leaving it unchanged.", user.ID, float64(user.USDCentsBalance)/100, amendment, standingOrder, float64(blockedAmount)/100)
+		return standingOrder, INSUFFICIENT_BALANCE
+	}
+	if standingOrder.Type == "SELL" && blockedAmount > user.BTCSatoshiBalance {
+		tx.Rollback()
+		ORDER_BOOK.Rollback()
+		log.Printf("User with ID %v only has %v BTC balance but the live standing orders including the amendment %v of the standing order %v would block %v BTC. Leaving it unchanged.", user.ID, float64(user.BTCSatoshiBalance)/100000000, amendment, standingOrder, float64(blockedAmount)/100000000)
+		return standingOrder, INSUFFICIENT_BALANCE
+	}
+	if standingOrder.PostOnly && ORDER_BOOK.BestOrder(getOppositeOrderType(standingOrder.Type), limitUsdCentsSatoshiPrice) != nil {
+		tx.Rollback()
+		ORDER_BOOK.Rollback()
+		log.Printf("The post-only standing order %v would match at the amended limit price. Leaving it unchanged.", standingOrder)
+		return standingOrder, POST_ONLY_WOULD_MATCH
+	}
+	priceChanged := limitUsdCentsSatoshiPrice != standingOrder.LimitPrice
+	quantityIncreased := satoshiAmount > standingOrder.RemainingQuantity
+	if priceChanged || quantityIncreased {
+		// the order goes to the back of the queue at its limit price
+		standingOrder.Sequence, err = getNextStandingOrderSequence(tx)
+		if err != nil {
+			tx.Rollback()
+			ORDER_BOOK.Rollback()
+			return nil, err
+		}
+	}
+	standingOrder.LimitPrice = limitUsdCentsSatoshiPrice
+	standingOrder.RemainingQuantity = satoshiAmount
+	if quantityIncreased {
+		// the visible part of an iceberg order might have been clamped by an earlier decrease
+		standingOrder.VisibleQuantity = standingOrder.DisplayQuantity
+	}
+	standingOrder.clampVisibleQuantity()
+	result := tx.Save(standingOrder)
+	if err := result.Error; err != nil {
+		tx.Rollback()
+		ORDER_BOOK.Rollback()
+		log.Printf("Unable to save the standing order %v. Error: %v", standingOrder, err)
+		return nil, err
+	}
+	err = standingOrder.EnqueueWebhook(tx, "ORDER_AMENDED")
+	if err != nil {
+		tx.Rollback()
+		ORDER_BOOK.Rollback()
+		return nil, err
+	}
+	ORDER_BOOK.Update(standingOrder)
+	result = tx.Commit()
+	if err := result.Error; err != nil {
+		tx.Rollback()
+		ORDER_BOOK.Rollback()
+		log.Printf("Unable to commit the transaction. Error: %v", result.Error)
+		return nil, err
+	}
+	ORDER_BOOK.Commit()
+	if priceChanged && !standingOrder.PostOnly {
+		// the new limit price might match the other standing orders
+		go user.ExecuteStandingOrder(standingOrder)
+	}
+	return standingOrder, nil
+}
+
 // Get the user's standing order with the provided ID.
 func (user *User) GetStandingOrder(id int64) (*StandingOrder, error) {
 	return getStandingOrderFromDb(DB, id)
@@ -111,94 +346,203 @@ func (user *User) GetStandingOrder(id int64) (*StandingOrder, error) {
 
 // Get the amount of USD cents that are blocked by the remaining parts of the user's live standing orders.
 func (user *User) GetBlockedUsdCents(tx *gorm.DB) (int64, error) {
-	var standingOrders []*StandingOrder
-	result := tx.Where(&StandingOrder{Type: "BUY", State: "LIVE", UserId: user.ID}).Select("remaining_quantity", "limit_price").Find(&standingOrders)
-	if err := result.Error; err != nil {
-		log.Printf("Unable to get standing orders of user with ID %v. Error: %v", user.ID, err)
-		return 0, err
-	}
-	var blockedUsdCentsAmount int64 = 0
-	for _, standingOrder := range standingOrders {
-		log.Printf("Standing order: Type: %T, Value: %v", standingOrder, standingOrder)
-		blockedUsdCentsAmount += int64(float64(standingOrder.RemainingQuantity) * standingOrder.LimitPrice)
-	}
-	return blockedUsdCentsAmount, nil
+	return user.getBlockedAmount(tx, "BUY", nil)
 }
 
 // Get the amount of Satoshis that are blocked by the remaining parts of the user's live standing orders.
 func (user *User) GetBlockedSatoshis(tx *gorm.DB) (int64, error) {
+	return user.getBlockedAmount(tx, "SELL", nil)
+}
+
+// Get the amount that is blocked by the remaining parts of the user's live standing orders of the provided type,
+// in USD cents for the orders to buy and in Satoshis for the orders to sell.
+// The two live orders of an OCO pair share the amount blocked by the larger one of them.
+// If an amended standing order is provided, it is counted instead of its stored version.
+func (user *User) getBlockedAmount(tx *gorm.DB, orderType string, amendedStandingOrder *StandingOrder) (int64, error) {
 	var standingOrders []*StandingOrder
-	result := tx.Where(&StandingOrder{Type: "SELL", State: "LIVE", UserId: user.ID}).Select("remaining_quantity").Find(&standingOrders)
+	result := tx.Where(&StandingOrder{Type: orderType, State: "LIVE", UserId: user.ID}).Select("id", "remaining_quantity", "limit_price", "linked_order_id").Find(&standingOrders)
 	if err := result.Error; err != nil {
 		log.Printf("Unable to get standing orders of user with ID %v. Error: %v", user.ID, err)
 		return 0, err
 	}
-	var blockedSatoshiAmount int64 = 0
+	// the blocked amounts by the ID of the first order of the OCO pair or of the order itself
+	blockedAmounts := map[int64]int64{}
 	for _, standingOrder := range standingOrders {
+		if amendedStandingOrder != nil && standingOrder.ID == amendedStandingOrder.ID {
+			standingOrder = amendedStandingOrder
+		}
 		log.Printf("Standing order: Type: %T, Value: %v", standingOrder, standingOrder)
-		blockedSatoshiAmount += standingOrder.RemainingQuantity
+		blockedAmount := standingOrder.RemainingQuantity
+		if orderType == "BUY" {
+			blockedAmount = int64(float64(standingOrder.RemainingQuantity) * standingOrder.LimitPrice)
+		}
+		key := standingOrder.ID
+		if standingOrder.LinkedOrderId != 0 && standingOrder.LinkedOrderId < key {
+			key = standingOrder.LinkedOrderId
+		}
+		if blockedAmount > blockedAmounts[key] {
+			blockedAmounts[key] = blockedAmount
+		}
 	}
-	return blockedSatoshiAmount, nil
+	var totalBlockedAmount int64 = 0
+	for _, blockedAmount := range blockedAmounts {
+		totalBlockedAmount += blockedAmount
+	}
+	return totalBlockedAmount, nil
 }
 
+// Execute the provided standing order against the other standing orders in the order book.
+// The unfilled part of an IOC order is cancelled.
+// A FOK order which cannot be filled in full is cancelled without any trades.
 func (user *User) ExecuteStandingOrder(standingOrder *StandingOrder) error {
 	log.Printf("Executing standing order %v.", standingOrder)
 	var satisfiedSatoshiAmount int64
-	var averageSatoshiUsdCentsPrice float64
-	var err error
+	var usdCentsAmount int64
+	ORDER_BOOK.Begin()
 	tx := DB.Begin()
+	// The provided standing order and user might have changed
+	// since they have been read from the database.
+	standingOrder, err := getStandingOrderFromDb(tx, standingOrder.ID)
+	if err != nil {
+		tx.Rollback()
+		ORDER_BOOK.Rollback()
+		return err
+	}
+	if standingOrder.State != "LIVE" || standingOrder.IsExpired() {
+		tx.Rollback()
+		ORDER_BOOK.Rollback()
+		log.Printf("Standing order %v is no longer live.", standingOrder)
+		return nil
+	}
+	immediate := standingOrder.TimeInForce == "IOC" || standingOrder.TimeInForce == "FOK"
+	_, err = getUserFromDb(tx, user)
+	if err != nil {
+		tx.Rollback()
+		ORDER_BOOK.Rollback()
+		return err
+	}
 	if standingOrder.Type == "BUY" {
-		satisfiedSatoshiAmount, averageSatoshiUsdCentsPrice, err = user.BuySatoshis(tx, standingOrder.RemainingQuantity, standingOrder.LimitPrice)
+		satisfiedSatoshiAmount, usdCentsAmount, _, _, err = user.BuySatoshis(tx, standingOrder.ID, standingOrder.RemainingQuantity, 0, standingOrder.LimitPrice)
 	} else { // standingOrder.Type == "SELL"
-		satisfiedSatoshiAmount, averageSatoshiUsdCentsPrice, err = user.SellSatoshis(tx, standingOrder.RemainingQuantity, standingOrder.LimitPrice)
+		satisfiedSatoshiAmount, usdCentsAmount, _, _, err = user.SellSatoshis(tx, standingOrder.ID, standingOrder.RemainingQuantity, 0, standingOrder.LimitPrice)
 	}
-	if errors.Is(err, NO_MATCHING_STANDING_ORDERS) {
+	if errors.Is(err, NO_MATCHING_STANDING_ORDERS) && !immediate {
 		// It is also possible to commit in this case
 		// because no changes have been made to the database yet.
 		// The rollback operation is used for consistency.
 		tx.Rollback()
+		ORDER_BOOK.Rollback()
 		log.Println("No matching standing order.")
 		return nil
 	}
+	if errors.Is(err, NO_MATCHING_STANDING_ORDERS) {
+		// the immediate order is cancelled below
+		satisfiedSatoshiAmount = 0
+		err = nil
+	}
 	if err != nil {
 		tx.Rollback()
+		ORDER_BOOK.Rollback()
 		log.Printf("Unable to execute standing order %v. Error: %v", standingOrder, err)
 		return err
 	}
-	standingOrder.AveragePrice = (standingOrder.AveragePrice*float64(standingOrder.FulfilledQuantity) + averageSatoshiUsdCentsPrice*float64(satisfiedSatoshiAmount)) / float64(standingOrder.FulfilledQuantity+satisfiedSatoshiAmount)
-	standingOrder.FulfilledQuantity += satisfiedSatoshiAmount
-	standingOrder.RemainingQuantity -= satisfiedSatoshiAmount
+	if standingOrder.TimeInForce == "FOK" && satisfiedSatoshiAmount < standingOrder.RemainingQuantity {
+		// none of the trades are kept
+		tx.Rollback()
+		ORDER_BOOK.Rollback()
+		log.Printf("Unable to fill the fill-or-kill standing order %v in full. Cancelling it.", standingOrder)
+		return user.DeleteStandingOrder(standingOrder.ID)
+	}
+	if satisfiedSatoshiAmount > 0 {
+		standingOrder.AveragePrice = (standingOrder.AveragePrice*float64(standingOrder.FulfilledQuantity) + float64(usdCentsAmount)) / float64(standingOrder.FulfilledQuantity+satisfiedSatoshiAmount)
+		standingOrder.FulfilledQuantity += satisfiedSatoshiAmount
+		standingOrder.RemainingQuantity -= satisfiedSatoshiAmount
+		standingOrder.clampVisibleQuantity()
+	}
 	if standingOrder.RemainingQuantity == 0 {
 		standingOrder.State = "FULFILLED"
+	} else if immediate {
+		// the immediate orders never rest in the order book
+		standingOrder.State = "CANCELLED"
 	}
 	result := tx.Save(standingOrder)
 	if err := result.Error; err != nil {
 		tx.Rollback()
+		ORDER_BOOK.Rollback()
 		log.Printf("Unable to save the standing order %v. Error: %v", standingOrder, err)
 		return err
 	}
+	if satisfiedSatoshiAmount > 0 {
+		err = standingOrder.EnqueueWebhook(tx, "ORDER_FILLED")
+		if err != nil {
+			tx.Rollback()
+			ORDER_BOOK.Rollback()
+			return err
+		}
+		_, err = standingOrder.CancelLinkedOrder(tx)
+		if err != nil {
+			tx.Rollback()
+			ORDER_BOOK.Rollback()
+			return err
+		}
+	}
+	if standingOrder.State == "CANCELLED" {
+		err = standingOrder.EnqueueWebhook(tx, "ORDER_CANCELLED")
+		if err != nil {
+			tx.Rollback()
+			ORDER_BOOK.Rollback()
+			return err
+		}
+	}
+	ORDER_BOOK.Update(standingOrder)
 	result = tx.Commit()
 	if err := result.Error; err != nil {
 		tx.Rollback()
+		ORDER_BOOK.Rollback()
 		log.Printf("Unable to commit the transaction. Error: %v", result.Error)
 		return err
 	}
-	standingOrder.PerformWebhookRequest()
+	ORDER_BOOK.Commit()
 	return nil
 }
 
 // Create the user's standing order from the provided HTTP request.
 // If the order has been successfully created,
 // try to execute it against the other standing orders.
+// The IOC and FOK orders are executed before returning
+// and never become a part of the order book.
+// The post-only orders are not executed at all.
+// The stop orders are only created and left to be triggered later.
+// The provided transaction must be accompanied by an order book session
+// started before it, which is finished together with the transaction.
 func (user *User) CreateStandingOrder(tx *gorm.DB, newStandingOrder *NewStandingOrder) (*StandingOrder, error) {
+	if newStandingOrder.IsStopOrder() {
+		return user.CreateStopOrder(tx, newStandingOrder)
+	}
+	standingOrder, err := user.insertStandingOrder(tx, newStandingOrder)
+	if standingOrder == nil {
+		return nil, err
+	}
+	return user.commitStandingOrder(tx, standingOrder, err)
+}
+
+// Create the user's standing order from the provided new standing order
+// within the provided transaction, which is left in progress.
+// The order is created as cancelled if the user's available balance is insufficient
+// or if it is post-only and would match on arrival, in which case the reason is returned with it.
+// If the order cannot be created at all, the transaction and the order book session are rolled back.
+func (user *User) insertStandingOrder(tx *gorm.DB, newStandingOrder *NewStandingOrder) (*StandingOrder, error) {
 	satoshiAmount := int64(newStandingOrder.Quantity * 100000000)
 	limitUsdCentsSatoshiPrice := newStandingOrder.LimitPrice / 1000000
 	state := "LIVE"
+	// The order book is checked and updated within the same session
+	// so that no matching order can arrive between the check of a post-only order and its insertion.
 	if newStandingOrder.Type == "BUY" {
 		blockedUsdCentsAmount, err := user.GetBlockedUsdCents(tx)
 		log.Printf("User with ID %v has %v USD cents blocked by the live standing orders.", user.ID, blockedUsdCentsAmount)
 		if err != nil {
 			tx.Rollback()
+			ORDER_BOOK.Rollback()
 			log.Printf("Unable to determine the blocked USD cents amount of user with ID %v. Error: %v", user.ID, err)
 			return nil, err
 		}
@@ -213,6 +557,7 @@ func (user *User) CreateStandingOrder(tx *gorm.DB, newStandingOrder *NewStanding
 		log.Printf("User with ID %v has %v Satoshis blocked by the live standing orders.", user.ID, blockedSatoshiAmount)
 		if err != nil {
 			tx.Rollback()
+			ORDER_BOOK.Rollback()
 			log.Printf("Unable to determine the blocked Satoshi amount of user with ID %v. Error: %v", user.ID, err)
 			return nil, err
 		}
@@ -222,6 +567,25 @@ func (user *User) CreateStandingOrder(tx *gorm.DB, newStandingOrder *NewStanding
 			state = "CANCELLED"
 		}
 	}
+	var err error = nil
+	if state == "LIVE" && newStandingOrder.PostOnly {
+		oppositeType := getOppositeOrderType(newStandingOrder.Type)
+		if ORDER_BOOK.BestOrder(oppositeType, limitUsdCentsSatoshiPrice) != nil {
+			repricedLimitUsdCentsSatoshiPrice := getPriceTicksAway(ORDER_BOOK.bestPrice(oppositeType), 1)
+			if newStandingOrder.Type == "BUY" {
+				repricedLimitUsdCentsSatoshiPrice = getPriceTicksAway(ORDER_BOOK.bestPrice(oppositeType), -1)
+			}
+			if newStandingOrder.Reprice && repricedLimitUsdCentsSatoshiPrice > 0 {
+				log.Printf("The post-only standing order %v would match on arrival. Repricing it to %v USD for one BTC.", newStandingOrder, repricedLimitUsdCentsSatoshiPrice*1000000)
+				// the lower limit price of a buy order only decreases the blocked amount
+				limitUsdCentsSatoshiPrice = repricedLimitUsdCentsSatoshiPrice
+			} else {
+				log.Printf("The post-only standing order %v would match on arrival. Marking it as cancelled.", newStandingOrder)
+				state = "CANCELLED"
+				err = POST_ONLY_WOULD_MATCH
+			}
+		}
+	}
 	standingOrder := &StandingOrder{
 		Type:              newStandingOrder.Type,
 		State:             state,
@@ -229,24 +593,50 @@ func (user *User) CreateStandingOrder(tx *gorm.DB, newStandingOrder *NewStanding
 		LimitPrice:        limitUsdCentsSatoshiPrice,
 		WebhookURL:        newStandingOrder.WebhookURL,
 		UserId:            user.ID,
+		TimeInForce:       newStandingOrder.TimeInForce,
+		ExpiresAt:         newStandingOrder.ExpiresAt,
+		PostOnly:          newStandingOrder.PostOnly,
+		DisplayQuantity:   int64(newStandingOrder.DisplayQuantity * 100000000),
 	}
+	standingOrder.VisibleQuantity = standingOrder.DisplayQuantity
+	standingOrder.clampVisibleQuantity()
 	result := tx.Create(standingOrder)
 	if err := result.Error; err != nil {
 		tx.Rollback()
+		ORDER_BOOK.Rollback()
 		log.Printf("Unable to create standing order %v. Error: %v", standingOrder, err)
 		return nil, err
 	}
-	result = tx.Commit()
+	if state == "CANCELLED" && err == nil {
+		err = INSUFFICIENT_BALANCE
+	}
+	return standingOrder, err
+}
+
+// Commit the provided transaction in which the provided standing order has been created
+// together with the accompanying order book session and execute the order if it is live.
+// The provided error is the reason why the order has been created as cancelled, if it has.
+func (user *User) commitStandingOrder(tx *gorm.DB, standingOrder *StandingOrder, err error) (*StandingOrder, error) {
+	immediate := standingOrder.TimeInForce == "IOC" || standingOrder.TimeInForce == "FOK"
+	result := tx.Commit()
 	if err := result.Error; err != nil {
 		tx.Rollback()
+		ORDER_BOOK.Rollback()
 		log.Printf("Unable to commit the transaction. Error: %v", result.Error)
 		return nil, err
 	}
 	// transaction is no longer in progress here
-	var err error = nil
-	if state == "CANCELLED" {
-		err = INSUFFICIENT_BALANCE
-	} else {
+	if standingOrder.State == "LIVE" && !immediate {
+		ORDER_BOOK.Update(standingOrder)
+	}
+	ORDER_BOOK.Commit()
+	if standingOrder.State == "CANCELLED" {
+		// the order is not executed
+		return standingOrder, err
+	}
+	if immediate {
+		err = user.ExecuteStandingOrder(standingOrder)
+	} else if !standingOrder.PostOnly {
 		go user.ExecuteStandingOrder(standingOrder)
 	}
 	return standingOrder, err
@@ -275,13 +665,96 @@ func getNewStandingOrderFromRequest(r *http.Request) (*NewStandingOrder, error)
 		log.Printf("Unable to decode NewStandingOrder from JSON. Error: %v", err)
 		return nil, err
 	}
-	if newStandingOrder.Type != "BUY" && newStandingOrder.Type != "SELL" {
-		err = fmt.Errorf("Unknown type %v of standing order has been provided.", newStandingOrder.Type)
+	err = validateNewStandingOrder(&newStandingOrder)
+	if err != nil {
 		return nil, err
 	}
 	return &newStandingOrder, nil
 }
 
+// Check the provided new standing order and fill in the default values of its optional fields.
+func validateNewStandingOrder(newStandingOrder *NewStandingOrder) error {
+	if newStandingOrder.Type != "BUY" && newStandingOrder.Type != "SELL" {
+		return fmt.Errorf("Unknown type %v of standing order has been provided.", newStandingOrder.Type)
+	}
+	// the quantities below one Satoshi are not positive once converted to Satoshis
+	if int64(newStandingOrder.Quantity*100000000) <= 0 {
+		return fmt.Errorf("Invalid quantity %v of standing order has been provided.", newStandingOrder.Quantity)
+	}
+	if newStandingOrder.TriggerPrice < 0 {
+		return fmt.Errorf("Invalid trigger price %v of standing order has been provided.", newStandingOrder.TriggerPrice)
+	}
+	if newStandingOrder.TrailAmount < 0 || newStandingOrder.TrailPercent < 0 || newStandingOrder.TrailPercent >= 100 {
+		return fmt.Errorf("Invalid trail amount %v or percent %v of standing order has been provided.", newStandingOrder.TrailAmount, newStandingOrder.TrailPercent)
+	}
+	if newStandingOrder.TrailAmount != 0 && newStandingOrder.TrailPercent != 0 {
+		return errors.New("Either the trail amount or the trail percent of standing order can be provided, not both.")
+	}
+	if newStandingOrder.LimitPrice < 0 || (newStandingOrder.LimitPrice == 0 && !newStandingOrder.IsStopOrder()) {
+		return fmt.Errorf("Invalid limit price %v of standing order has been provided.", newStandingOrder.LimitPrice)
+	}
+	stopMarket := newStandingOrder.IsStopOrder() && newStandingOrder.LimitPrice == 0
+	if newStandingOrder.TimeInForce == "" && stopMarket {
+		newStandingOrder.TimeInForce = "IOC"
+	}
+	if newStandingOrder.TimeInForce == "" {
+		newStandingOrder.TimeInForce = "GTC"
+	}
+	if stopMarket && newStandingOrder.TimeInForce != "IOC" && newStandingOrder.TimeInForce != "FOK" {
+		return fmt.Errorf("Unsupported time in force %v of stop-market order has been provided.", newStandingOrder.TimeInForce)
+	}
+	if stopMarket && newStandingOrder.PostOnly {
+		return errors.New("The stop-market orders cannot be post-only.")
+	}
+	if newStandingOrder.DisplayQuantity < 0 || newStandingOrder.DisplayQuantity > newStandingOrder.Quantity {
+		return fmt.Errorf("Invalid display quantity %v of standing order has been provided.", newStandingOrder.DisplayQuantity)
+	}
+	if newStandingOrder.DisplayQuantity != 0 && (stopMarket || newStandingOrder.TimeInForce == "IOC" || newStandingOrder.TimeInForce == "FOK") {
+		return errors.New("Only the standing orders which can rest in the order book can be iceberg orders.")
+	}
+	if !TIME_IN_FORCE_OPTIONS[newStandingOrder.TimeInForce] {
+		return fmt.Errorf("Unknown time in force %v of standing order has been provided.", newStandingOrder.TimeInForce)
+	}
+	if newStandingOrder.TimeInForce == "GTD" && newStandingOrder.ExpiresAt == nil {
+		return errors.New("No expiry time of the good-till-date standing order has been provided.")
+	}
+	if newStandingOrder.TimeInForce == "GTD" && !newStandingOrder.ExpiresAt.After(time.Now()) {
+		return fmt.Errorf("The expiry time %v of standing order has already passed.", newStandingOrder.ExpiresAt)
+	}
+	if newStandingOrder.TimeInForce != "GTD" && newStandingOrder.ExpiresAt != nil {
+		return errors.New("The expiry time can only be provided for the good-till-date standing orders.")
+	}
+	if newStandingOrder.PostOnly && (newStandingOrder.TimeInForce == "IOC" || newStandingOrder.TimeInForce == "FOK") {
+		return errors.New("The post-only standing orders cannot be executed immediately.")
+	}
+	if newStandingOrder.Reprice && !newStandingOrder.PostOnly {
+		return errors.New("Only the post-only standing orders can be repriced.")
+	}
+	return nil
+}
+
+func getStandingOrderAmendmentFromRequest(r *http.Request) (*StandingOrderAmendment, error) {
+	var amendment StandingOrderAmendment
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&amendment)
+	if err != nil {
+		log.Printf("Unable to decode StandingOrderAmendment from JSON. Error: %v", err)
+		return nil, err
+	}
+	if amendment.Quantity == nil && amendment.LimitPrice == nil {
+		return nil, errors.New("No changes of the standing order have been provided.")
+	}
+	// the quantities below one Satoshi are not positive once converted to Satoshis
+	if amendment.Quantity != nil && int64(*amendment.Quantity*100000000) <= 0 {
+		return nil, fmt.Errorf("Invalid quantity %v of standing order has been provided.", *amendment.Quantity)
+	}
+	if amendment.LimitPrice != nil && *amendment.LimitPrice <= 0 {
+		return nil, fmt.Errorf("Invalid limit price %v of standing order has been provided.", *amendment.LimitPrice)
+	}
+	return &amendment, nil
+}
+
 func deleteStandingOrderHandler(user *User, w http.ResponseWriter, r *http.Request) {
 	standingOrderId, err := getStandingOrderId(r)
 	if err != nil {
@@ -300,6 +773,11 @@ func deleteStandingOrderHandler(user *User, w http.ResponseWriter, r *http.Reque
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
+	if errors.Is(err, ORDER_NOT_LIVE) {
+		log.Printf("Standing order with ID %v is not live and cannot be deleted.", standingOrderId)
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
 	if err != nil {
 		log.Printf("Unable to delete standing order %v. Error: %v", standingOrderId, err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -335,18 +813,82 @@ func getStandingOrderHandler(user *User, w http.ResponseWriter, r *http.Request)
 	w.Write(output)
 }
 
-func postStandingOrderHandler(tx *gorm.DB, user *User, w http.ResponseWriter, r *http.Request) {
+func patchStandingOrderHandler(user *User, w http.ResponseWriter, r *http.Request) {
+	standingOrderId, err := getStandingOrderId(r)
+	if err != nil {
+		log.Printf("Unable to get standing order ID. Error: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	amendment, err := getStandingOrderAmendmentFromRequest(r)
+	if err != nil {
+		log.Printf("Unable to get standing order amendment from request. Error: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	standingOrder, err := user.AmendStandingOrder(standingOrderId, amendment)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		log.Printf("Standing order with ID %v not found.", standingOrderId)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, PERMISSION_DENIED) {
+		log.Printf("No permission to amend standing order with ID %v.", standingOrderId)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if errors.Is(err, ORDER_NOT_LIVE) {
+		log.Printf("Standing order with ID %v is not live and cannot be amended.", standingOrderId)
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	if err != nil && !errors.Is(err, INSUFFICIENT_BALANCE) && !errors.Is(err, POST_ONLY_WOULD_MATCH) {
+		log.Printf("Unable to amend standing order %v. Error: %v", standingOrderId, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err != nil {
+		log.Printf("Unable to amend standing order %v with %v. Left unchanged. Reason: %v", standingOrderId, amendment, err)
+		w.WriteHeader(http.StatusConflict)
+		// the output will still contain the unchanged standing order
+	}
+	output, err := json.Marshal(standingOrder)
+	if err != nil {
+		log.Printf("Unable to serialize StandingOrder object to JSON. Error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Write(output)
+}
+
+func postStandingOrderHandler(user *User, w http.ResponseWriter, r *http.Request) {
 	newStandingOrder, err := getNewStandingOrderFromRequest(r)
 	if err != nil {
-		tx.Rollback()
 		log.Printf("Unable to get standing order from request. Error: %v", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	// the order book session needs to start before the transaction
+	// so that the transaction sees the changes made by the previous sessions
+	ORDER_BOOK.Begin()
+	tx := DB.Begin()
+	// the balances might have changed since the user has been authenticated
+	_, err = getUserFromDb(tx, user)
+	if err != nil {
+		tx.Rollback()
+		ORDER_BOOK.Rollback()
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 	// the CreateStandingOrder method commits or rolls back the transaction as necessary
 	standingOrder, err := user.CreateStandingOrder(tx, newStandingOrder)
 	// transaction is no longer in progress here
-	if err != nil && !errors.Is(err, INSUFFICIENT_BALANCE) {
+	if errors.Is(err, NO_PRICE_AVAILABLE) {
+		log.Printf("No last trade price to derive the trigger price of the trailing stop order %v from.", newStandingOrder)
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	if err != nil && !errors.Is(err, INSUFFICIENT_BALANCE) && !errors.Is(err, POST_ONLY_WOULD_MATCH) {
 		log.Printf("Unable to create standing order %v. Error: %v", newStandingOrder, err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -356,6 +898,10 @@ func postStandingOrderHandler(tx *gorm.DB, user *User, w http.ResponseWriter, r
 		w.WriteHeader(http.StatusConflict)
 		// the output will still contain the created standing order's ID
 	}
+	if errors.Is(err, POST_ONLY_WOULD_MATCH) {
+		log.Printf("The post-only standing order %v would match on arrival. Created as cancelled.", newStandingOrder)
+		w.WriteHeader(http.StatusConflict)
+	}
 	output, err := json.Marshal(StandingOrderId{ID: standingOrder.ID})
 	if err != nil {
 		log.Printf("Unable to serialize StandingOrderId object to JSON. Error: %v", err)
@@ -382,10 +928,22 @@ func standingOrderHandler(w http.ResponseWriter, r *http.Request) {
 	case "GET":
 		// DB transaction with the read operation on user is unnecessary in this case
 		tx.Rollback()
-		getStandingOrderHandler(user, w, r)
+		match := URL_PATH_PARTS.FindStringSubmatch(html.EscapeString(r.URL.Path))
+		if match == nil || match[2] == "" {
+			// no standing order ID means listing the user's standing orders
+			listStandingOrdersHandler(user, w, r)
+		} else {
+			getStandingOrderHandler(user, w, r)
+		}
+	case "PATCH":
+		// the amendment is made in its own DB transaction
+		tx.Rollback()
+		patchStandingOrderHandler(user, w, r)
 	case "POST":
-		// the POST handler commits or rolls back the transaction as necessary
-		postStandingOrderHandler(tx, user, w, r)
+		// the standing order is created in its own DB transaction
+		// which starts after the order book session
+		tx.Rollback()
+		postStandingOrderHandler(user, w, r)
 	default:
 		tx.Rollback()
 		w.WriteHeader(http.StatusMethodNotAllowed)
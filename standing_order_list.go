@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The criteria for listing the user's standing orders.
+type StandingOrderFilter struct {
+	// empty Type or State matches any value
+	Type          string
+	State         string
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+	// whether to list the oldest orders first
+	Ascending bool
+	// ID of the last order of the previous page or zero for the first page
+	Cursor int64
+	Limit  int
+}
+
+// A page of the listed standing orders.
+type StandingOrderPage struct {
+	Orders []*StandingOrder `json:"orders"`
+	// The cursor to be provided to get the next page.
+	// It is null if there are no more orders.
+	NextCursor *string `json:"next_cursor"`
+}
+
+func parseTimeParameter(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		log.Printf("Unable to parse the provided time. Error: %v", err)
+		return nil, err
+	}
+	return &parsed, nil
+}
+
+// Get the criteria for listing the standing orders from the URL query parameters.
+func getStandingOrderFilterFromRequest(r *http.Request) (*StandingOrderFilter, error) {
+	query := r.URL.Query()
+	filter := &StandingOrderFilter{
+		Type:  query.Get("type"),
+		State: query.Get("state"),
+		Limit: DEFAULT_PAGE_SIZE,
+	}
+	if filter.Type != "" && filter.Type != "BUY" && filter.Type != "SELL" {
+		return nil, fmt.Errorf("Unknown type %v of standing order has been provided.", filter.Type)
+	}
+	var err error
+	filter.CreatedAfter, err = parseTimeParameter(query.Get("created_after"))
+	if err != nil {
+		return nil, err
+	}
+	filter.CreatedBefore, err = parseTimeParameter(query.Get("created_before"))
+	if err != nil {
+		return nil, err
+	}
+	switch query.Get("order") {
+	case "", "desc":
+		filter.Ascending = false
+	case "asc":
+		filter.Ascending = true
+	default:
+		return nil, fmt.Errorf("Unknown order %v has been provided.", query.Get("order"))
+	}
+	if value := query.Get("cursor"); value != "" {
+		filter.Cursor, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			log.Printf("Unable to convert provided string to int64. Error: %v", err)
+			return nil, err
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		filter.Limit, err = strconv.Atoi(value)
+		if err != nil {
+			log.Printf("Unable to convert provided string to int. Error: %v", err)
+			return nil, err
+		}
+		if filter.Limit <= 0 || filter.Limit > MAX_PAGE_SIZE {
+			return nil, fmt.Errorf("The limit %v is out of the allowed range from 1 to %v.", filter.Limit, MAX_PAGE_SIZE)
+		}
+	}
+	return filter, nil
+}
+
+// Get a page of the user's standing orders which match the provided criteria,
+// sorted by the time of their creation.
+func (user *User) ListStandingOrders(filter *StandingOrderFilter) (*StandingOrderPage, error) {
+	// The conditions on the user, type and state can use the idx_user index.
+	// The IDs are assigned in the order of creation, so they can be used for sorting and as the cursor.
+	query := DB.Where(&StandingOrder{UserId: user.ID, Type: filter.Type, State: filter.State})
+	if filter.CreatedAfter != nil {
+		query = query.Where("created_at >= ?", *filter.CreatedAfter)
+	}
+	if filter.CreatedBefore != nil {
+		query = query.Where("created_at < ?", *filter.CreatedBefore)
+	}
+	if filter.Ascending {
+		if filter.Cursor != 0 {
+			query = query.Where("id > ?", filter.Cursor)
+		}
+		query = query.Order("id asc")
+	} else {
+		if filter.Cursor != 0 {
+			query = query.Where("id < ?", filter.Cursor)
+		}
+		query = query.Order("id desc")
+	}
+	standingOrders := []*StandingOrder{}
+	// one more order is requested to find out whether there is a next page
+	result := query.Limit(filter.Limit + 1).Find(&standingOrders)
+	if err := result.Error; err != nil {
+		log.Printf("Unable to list standing orders of user with ID %v. Error: %v", user.ID, err)
+		return nil, err
+	}
+	page := &StandingOrderPage{Orders: standingOrders}
+	if len(standingOrders) > filter.Limit {
+		page.Orders = standingOrders[:filter.Limit]
+		nextCursor := fmt.Sprint(page.Orders[filter.Limit-1].ID)
+		page.NextCursor = &nextCursor
+	}
+	return page, nil
+}
+
+func listStandingOrdersHandler(user *User, w http.ResponseWriter, r *http.Request) {
+	filter, err := getStandingOrderFilterFromRequest(r)
+	if err != nil {
+		log.Printf("Unable to get the standing order filter. Error: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	page, err := user.ListStandingOrders(filter)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	output, err := json.Marshal(page)
+	if err != nil {
+		log.Printf("Unable to serialize StandingOrderPage object to JSON. Error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Write(output)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestGetPriceTicksAway(t *testing.T) {
+	tests := []struct {
+		// in USD for one BTC
+		price float64
+		ticks int64
+		// in USD for one BTC, as entered with a new standing order
+		expected float64
+	}{
+		{50000, 1, 50000.01},
+		{50000, -1, 49999.99},
+		{50000, 0, 50000},
+		{0.07, 1, 0.08},
+		{123456.78, 1, 123456.79},
+		{123456.78, -1, 123456.77},
+		{99999.99, 1, 100000},
+	}
+	for _, test := range tests {
+		// converted in the same way as the limit price of a new standing order
+		price := getPriceTicksAway(test.price/1000000, test.ticks)
+		if price != test.expected/1000000 {
+			t.Errorf("The price %v ticks away from %v USD is %v USD, expected %v USD.", test.ticks, test.price, price*1000000, test.expected)
+		}
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"errors"
+	"log"
+
+	"gorm.io/gorm"
+)
+
+// Signals that the stop orders need to be checked against the last trade price.
+// Holds at most one signal because a single check covers all the trades made before it.
+var STOP_ORDER_SIGNAL = make(chan bool, 1)
+
+// Request the check of the stop orders without waiting for it.
+func signalStopOrders() {
+	select {
+	case STOP_ORDER_SIGNAL <- true:
+	default:
+		// the check has already been requested
+	}
+}
+
+// Create the user's untriggered stop order from the provided new standing order
+// and commit the provided transaction together with the accompanying order book session.
+// No balance is blocked by the stop order until it is triggered.
+func (user *User) CreateStopOrder(tx *gorm.DB, newStandingOrder *NewStandingOrder) (*StandingOrder, error) {
+	stopOrder, err := user.newStopOrder(tx, newStandingOrder)
+	if err != nil {
+		tx.Rollback()
+		ORDER_BOOK.Rollback()
+		return nil, err
+	}
+	result := tx.Create(stopOrder)
+	if err := result.Error; err != nil {
+		tx.Rollback()
+		ORDER_BOOK.Rollback()
+		log.Printf("Unable to create stop order %v. Error: %v", stopOrder, err)
+		return nil, err
+	}
+	result = tx.Commit()
+	if err := result.Error; err != nil {
+		tx.Rollback()
+		ORDER_BOOK.Rollback()
+		log.Printf("Unable to commit the transaction. Error: %v", result.Error)
+		return nil, err
+	}
+	ORDER_BOOK.Commit()
+	// the last trade price might have already crossed the trigger price
+	signalStopOrders()
+	return stopOrder, nil
+}
+
+// Get the user's untriggered stop order described by the provided new standing order,
+// which is yet to be saved.
+// If no trigger price of a trailing stop order is provided,
+// it is derived from the last trade price.
+func (user *User) newStopOrder(tx *gorm.DB, newStandingOrder *NewStandingOrder) (*StandingOrder, error) {
+	stopOrder := &StandingOrder{
+		Type:              newStandingOrder.Type,
+		State:             "UNTRIGGERED",
+		RemainingQuantity: int64(newStandingOrder.Quantity * 100000000),
+		LimitPrice:        newStandingOrder.LimitPrice / 1000000,
+		TriggerPrice:      newStandingOrder.TriggerPrice / 1000000,
+		WebhookURL:        newStandingOrder.WebhookURL,
+		UserId:            user.ID,
+		TimeInForce:       newStandingOrder.TimeInForce,
+		ExpiresAt:         newStandingOrder.ExpiresAt,
+		PostOnly:          newStandingOrder.PostOnly,
+		TrailAmount:       newStandingOrder.TrailAmount / 1000000,
+		TrailPercent:      newStandingOrder.TrailPercent,
+		DisplayQuantity:   int64(newStandingOrder.DisplayQuantity * 100000000),
+	}
+	lastTrade, err := getLastTrade(tx)
+	if err != nil && !errors.Is(err, NO_PRICE_AVAILABLE) {
+		return nil, err
+	}
+	if lastTrade != nil {
+		stopOrder.CheckedTradeId = lastTrade.ID
+	}
+	if stopOrder.TriggerPrice == 0 {
+		if lastTrade == nil {
+			return nil, NO_PRICE_AVAILABLE
+		}
+		stopOrder.TriggerPrice = getTrailingTriggerPrice(stopOrder, lastTrade.Price)
+	}
+	return stopOrder, nil
+}
+
+// Trigger the provided stop order.
+// A stop-market order is performed as a market order on its own behalf,
+// so the resulting trades are its fills.
+// A stop-limit order creates a new standing order with its limit price,
+// whose ID is recorded in the stop order.
+func (user *User) TriggerStopOrder(stopOrder *StandingOrder) error {
+	err := user.triggerStopOrder(stopOrder, true)
+	if errors.Is(err, NOT_FILLED_IN_FULL) {
+		// the trades of the fill-or-kill market order have been rolled back
+		return user.triggerStopOrder(stopOrder, false)
+	}
+	return err
+}
+
+// Trigger the provided stop order,
+// performing its market order only if requested.
+func (user *User) triggerStopOrder(stopOrder *StandingOrder, performMarketOrder bool) error {
+	log.Printf("Triggering stop order %v.", stopOrder)
+	ORDER_BOOK.Begin()
+	tx := DB.Begin()
+	// The provided stop order might have been cancelled or triggered in the meantime.
+	stopOrder, err := getStandingOrderFromDb(tx, stopOrder.ID)
+	if err != nil {
+		tx.Rollback()
+		ORDER_BOOK.Rollback()
+		return err
+	}
+	if stopOrder.State != "UNTRIGGERED" {
+		tx.Rollback()
+		ORDER_BOOK.Rollback()
+		log.Printf("Stop order %v is no longer untriggered.", stopOrder)
+		return nil
+	}
+	_, err = getUserFromDb(tx, user)
+	if err != nil {
+		tx.Rollback()
+		ORDER_BOOK.Rollback()
+		return err
+	}
+	stopOrder.State = "TRIGGERED"
+	// the other order of an OCO pair is cancelled before the balance blocked by it is needed
+	_, err = stopOrder.CancelLinkedOrder(tx)
+	if err != nil {
+		tx.Rollback()
+		ORDER_BOOK.Rollback()
+		return err
+	}
+	if stopOrder.LimitPrice == 0 && performMarketOrder {
+		marketOrder := &MarketOrder{
+			Quantity:    float64(stopOrder.RemainingQuantity) / 100000000,
+			Type:        stopOrder.Type,
+			TimeInForce: stopOrder.TimeInForce,
+		}
+		satisfiedSatoshiAmount, usdCentsAmount, _, _, err := user.PerformMarketOrder(tx, stopOrder.ID, marketOrder)
+		if errors.Is(err, NO_MATCHING_STANDING_ORDERS) {
+			log.Printf("Stop-market order %v has been triggered without any trades.", stopOrder)
+			satisfiedSatoshiAmount = 0
+			err = nil
+		}
+		if err != nil {
+			tx.Rollback()
+			ORDER_BOOK.Rollback()
+			log.Printf("Unable to perform the market order of stop order %v. Error: %v", stopOrder, err)
+			return err
+		}
+		if satisfiedSatoshiAmount > 0 {
+			stopOrder.AveragePrice = float64(usdCentsAmount) / float64(satisfiedSatoshiAmount)
+			stopOrder.FulfilledQuantity = satisfiedSatoshiAmount
+			stopOrder.RemainingQuantity -= satisfiedSatoshiAmount
+		}
+	}
+	result := tx.Save(stopOrder)
+	if err := result.Error; err != nil {
+		tx.Rollback()
+		ORDER_BOOK.Rollback()
+		log.Printf("Unable to save the stop order %v. Error: %v", stopOrder, err)
+		return err
+	}
+	if stopOrder.LimitPrice == 0 {
+		err = stopOrder.EnqueueWebhook(tx, "ORDER_TRIGGERED")
+		if err != nil {
+			tx.Rollback()
+			ORDER_BOOK.Rollback()
+			return err
+		}
+		result = tx.Commit()
+		if err := result.Error; err != nil {
+			tx.Rollback()
+			ORDER_BOOK.Rollback()
+			log.Printf("Unable to commit the transaction. Error: %v", result.Error)
+			return err
+		}
+		ORDER_BOOK.Commit()
+		return nil
+	}
+	// The stop-limit order is triggered in the same transaction and order book session
+	// in which its standing order is created and linked to it.
+	standingOrder, err := user.insertStandingOrder(tx, &NewStandingOrder{
+		Type:            stopOrder.Type,
+		Quantity:        float64(stopOrder.RemainingQuantity) / 100000000,
+		LimitPrice:      stopOrder.LimitPrice * 1000000,
+		WebhookURL:      stopOrder.WebhookURL,
+		TimeInForce:     stopOrder.TimeInForce,
+		ExpiresAt:       stopOrder.ExpiresAt,
+		PostOnly:        stopOrder.PostOnly,
+		DisplayQuantity: float64(stopOrder.DisplayQuantity) / 100000000,
+	})
+	if standingOrder == nil {
+		// the cancellation of the other order of the OCO pair has been rolled back as well
+		log.Printf("Unable to create the standing order of stop order %v. Error: %v", stopOrder, err)
+		return err
+	}
+	stopOrder.TriggeredOrderId = standingOrder.ID
+	result = tx.Model(stopOrder).Update("triggered_order_id", stopOrder.TriggeredOrderId)
+	if err := result.Error; err != nil {
+		tx.Rollback()
+		ORDER_BOOK.Rollback()
+		log.Printf("Unable to save the stop order %v. Error: %v", stopOrder, err)
+		return err
+	}
+	webhookErr := stopOrder.EnqueueWebhook(tx, "ORDER_TRIGGERED")
+	if webhookErr != nil {
+		tx.Rollback()
+		ORDER_BOOK.Rollback()
+		return webhookErr
+	}
+	standingOrder, err = user.commitStandingOrder(tx, standingOrder, err)
+	// transaction is no longer in progress here
+	if standingOrder == nil {
+		log.Printf("Unable to create the standing order of stop order %v. Error: %v", stopOrder, err)
+		return err
+	}
+	if err != nil {
+		// the standing order has been created as cancelled or has failed to execute
+		log.Printf("The standing order %v of stop order %v has not been fully successful. Error: %v", standingOrder, stopOrder, err)
+	}
+	return nil
+}
+
+// Get the trigger price of the provided trailing stop order
+// which follows the provided USD cents price for one Satoshi.
+func getTrailingTriggerPrice(stopOrder *StandingOrder, satoshiUsdCentsPrice float64) float64 {
+	if stopOrder.Type == "SELL" {
+		if stopOrder.TrailPercent != 0 {
+			return satoshiUsdCentsPrice * (1 - stopOrder.TrailPercent/100)
+		}
+		return satoshiUsdCentsPrice - stopOrder.TrailAmount
+	}
+	// stopOrder.Type == "BUY"
+	if stopOrder.TrailPercent != 0 {
+		return satoshiUsdCentsPrice * (1 + stopOrder.TrailPercent/100)
+	}
+	return satoshiUsdCentsPrice + stopOrder.TrailAmount
+}
+
+// Check whether the trigger price of the provided stop order
+// is crossed by the provided USD cents price for one Satoshi.
+func isTriggerPriceCrossed(stopOrder *StandingOrder, satoshiUsdCentsPrice float64) bool {
+	if stopOrder.Type == "BUY" {
+		return satoshiUsdCentsPrice >= stopOrder.TriggerPrice
+	}
+	return satoshiUsdCentsPrice <= stopOrder.TriggerPrice
+}
+
+// Follow the provided trades, sorted by their IDs, with the provided untriggered stop order.
+// Each trade made after the placement of the order against which it has not been checked yet
+// is checked against the trigger price in effect at the time of the trade
+// and only then moves the trigger price of a trailing stop order.
+// Returns whether the trigger price has been crossed,
+// in which case the trades after the crossing one are not followed.
+func followTrades(stopOrder *StandingOrder, trades []*Trade) bool {
+	trailing := stopOrder.TrailAmount != 0 || stopOrder.TrailPercent != 0
+	for _, trade := range trades {
+		if trade.ID <= stopOrder.CheckedTradeId || trade.CreatedAt.Before(stopOrder.CreatedAt) {
+			continue
+		}
+		if isTriggerPriceCrossed(stopOrder, trade.Price) {
+			return true
+		}
+		if !trailing {
+			continue
+		}
+		// the trigger price of a trailing stop order to sell only rises and to buy only falls
+		triggerPrice := getTrailingTriggerPrice(stopOrder, trade.Price)
+		if (stopOrder.Type == "SELL" && triggerPrice > stopOrder.TriggerPrice) || (stopOrder.Type == "BUY" && triggerPrice < stopOrder.TriggerPrice) {
+			stopOrder.TriggerPrice = triggerPrice
+		}
+	}
+	return false
+}
+
+// Trigger the untriggered stop orders whose trigger price has been crossed
+// by the price of any trade made after their placement since they have been checked,
+// so that the trades which cross the trigger price and come back before the check are not missed,
+// or by the last trade price in case of the stop orders placed after the last trade.
+// The trigger prices of the trailing stop orders follow the trades which have not crossed them.
+func triggerStopOrders() error {
+	lastTrade, err := getLastTrade(DB)
+	if errors.Is(err, NO_PRICE_AVAILABLE) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var stopOrders []*StandingOrder
+	result := DB.Where(&StandingOrder{State: "UNTRIGGERED"}).Where("checked_trade_id < ? OR (type = ? AND trigger_price <= ?) OR (type = ? AND trigger_price >= ?)", lastTrade.ID, "BUY", lastTrade.Price, "SELL", lastTrade.Price).Order("id asc").Find(&stopOrders)
+	if err := result.Error; err != nil {
+		log.Printf("Unable to get the stop orders to check. Error: %v", err)
+		return err
+	}
+	// the trades which any of the stop orders has not been checked against yet
+	checkedTradeId := lastTrade.ID
+	placedAt := lastTrade.CreatedAt
+	for _, stopOrder := range stopOrders {
+		if stopOrder.CheckedTradeId < checkedTradeId {
+			checkedTradeId = stopOrder.CheckedTradeId
+		}
+		if stopOrder.CheckedTradeId < lastTrade.ID && stopOrder.CreatedAt.Before(placedAt) {
+			placedAt = stopOrder.CreatedAt
+		}
+	}
+	var trades []*Trade
+	if checkedTradeId < lastTrade.ID {
+		result = DB.Where("id > ? AND id <= ? AND created_at >= ?", checkedTradeId, lastTrade.ID, placedAt).Order("id asc").Find(&trades)
+		if err := result.Error; err != nil {
+			log.Printf("Unable to get the trades to check the stop orders against. Error: %v", err)
+			return err
+		}
+	}
+	for _, stopOrder := range stopOrders {
+		triggered := false
+		if stopOrder.CheckedTradeId < lastTrade.ID {
+			triggered = followTrades(stopOrder, trades)
+		} else {
+			// the stop order has been placed after the last trade, whose price might have already crossed its trigger price
+			triggered = isTriggerPriceCrossed(stopOrder, lastTrade.Price)
+		}
+		if triggered {
+			user := &User{ID: stopOrder.UserId}
+			err := user.TriggerStopOrder(stopOrder)
+			if err != nil {
+				// the stop order is checked against the same trades again
+				log.Printf("Unable to trigger stop order %v. Error: %v", stopOrder, err)
+			}
+			continue
+		}
+		if stopOrder.CheckedTradeId == lastTrade.ID {
+			continue
+		}
+		result = DB.Model(stopOrder).Where(&StandingOrder{State: "UNTRIGGERED"}).Updates(map[string]interface{}{
+			"trigger_price":    stopOrder.TriggerPrice,
+			"checked_trade_id": lastTrade.ID,
+		})
+		if err := result.Error; err != nil {
+			log.Printf("Unable to record the trade against which the stop order %v has been checked. Error: %v", stopOrder, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// Keep triggering the stop orders in the background
+// whenever new trades have been made.
+func startStopOrderTrigger() {
+	log.Printf("Starting the stop order trigger.")
+	go func() {
+		for range STOP_ORDER_SIGNAL {
+			triggerStopOrders()
+		}
+	}()
+	// the trades made before the start might have crossed or moved the trigger prices
+	signalStopOrders()
+}
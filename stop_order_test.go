@@ -0,0 +1,140 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// Get the trades with the provided prices, made one second apart after the provided time
+// and numbered from the provided ID.
+func newTestTrades(firstId int64, madeAfter time.Time, prices ...float64) []*Trade {
+	var trades []*Trade
+	for i, price := range prices {
+		trades = append(trades, &Trade{
+			ID:        firstId + int64(i),
+			Price:     price,
+			CreatedAt: madeAfter.Add(time.Duration(i+1) * time.Second),
+		})
+	}
+	return trades
+}
+
+func TestIsTriggerPriceCrossed(t *testing.T) {
+	tests := []struct {
+		orderType string
+		price     float64
+		crossed   bool
+	}{
+		{"BUY", 0.09, false},
+		{"BUY", 0.1, true},
+		{"BUY", 0.11, true},
+		{"SELL", 0.11, false},
+		{"SELL", 0.1, true},
+		{"SELL", 0.09, true},
+	}
+	for _, test := range tests {
+		stopOrder := &StandingOrder{Type: test.orderType, TriggerPrice: 0.1}
+		crossed := isTriggerPriceCrossed(stopOrder, test.price)
+		if crossed != test.crossed {
+			t.Errorf("The trigger price of the %v stop order is crossed by %v: %v, expected %v.", test.orderType, test.price, crossed, test.crossed)
+		}
+	}
+}
+
+func TestFollowTrades(t *testing.T) {
+	placedAt := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name           string
+		orderType      string
+		checkedTradeId int64
+		trades         []*Trade
+		triggered      bool
+	}{
+		{"no trades", "SELL", 0, nil, false},
+		{"price above the trigger", "SELL", 0, newTestTrades(1, placedAt, 0.11, 0.12), false},
+		{"price at the trigger", "SELL", 0, newTestTrades(1, placedAt, 0.11, 0.1), true},
+		// the check happens after the price has come back
+		{"price crossing and coming back", "SELL", 0, newTestTrades(1, placedAt, 0.09, 0.11), true},
+		{"price crossing and coming back to buy", "BUY", 0, newTestTrades(1, placedAt, 0.11, 0.09), true},
+		{"crossing trade already checked", "SELL", 1, newTestTrades(1, placedAt, 0.09, 0.11), false},
+		{"crossing trade before the placement", "SELL", 0, newTestTrades(1, placedAt.Add(-1500*time.Millisecond), 0.09, 0.11), false},
+	}
+	for _, test := range tests {
+		stopOrder := &StandingOrder{
+			Type:           test.orderType,
+			State:          "UNTRIGGERED",
+			TriggerPrice:   0.1,
+			CheckedTradeId: test.checkedTradeId,
+			CreatedAt:      placedAt,
+		}
+		triggered := followTrades(stopOrder, test.trades)
+		if triggered != test.triggered {
+			t.Errorf("%v: The stop order has been triggered: %v, expected %v.", test.name, triggered, test.triggered)
+		}
+		if stopOrder.TriggerPrice != 0.1 {
+			t.Errorf("%v: The trigger price of the stop order has moved to %v.", test.name, stopOrder.TriggerPrice)
+		}
+	}
+}
+
+func TestGetTrailingTriggerPrice(t *testing.T) {
+	tests := []struct {
+		orderType    string
+		trailAmount  float64
+		trailPercent float64
+		triggerPrice float64
+	}{
+		{"SELL", 10, 0, 90},
+		{"SELL", 0, 5, 95},
+		{"BUY", 10, 0, 110},
+		{"BUY", 0, 5, 105},
+	}
+	for _, test := range tests {
+		stopOrder := &StandingOrder{Type: test.orderType, TrailAmount: test.trailAmount, TrailPercent: test.trailPercent}
+		triggerPrice := getTrailingTriggerPrice(stopOrder, 100)
+		if math.Abs(triggerPrice-test.triggerPrice) > 1e-9 {
+			t.Errorf("The trigger price of the %v stop order trailing by %v or %v%% at 100 is %v, expected %v.", test.orderType, test.trailAmount, test.trailPercent, triggerPrice, test.triggerPrice)
+		}
+	}
+}
+
+func TestFollowTradesTrailing(t *testing.T) {
+	placedAt := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name         string
+		orderType    string
+		prices       []float64
+		triggered    bool
+		triggerPrice float64
+	}{
+		{"rising price", "SELL", []float64{100, 105, 110}, false, 100},
+		{"falling price", "SELL", []float64{95, 91}, false, 90},
+		{"falling price after the peak", "SELL", []float64{105, 115, 106}, false, 105},
+		{"price falling by the trail amount", "SELL", []float64{105, 115, 105}, true, 105},
+		// each trade is checked against the trigger price in effect before the trade has moved it
+		{"price below the moved trigger price before the peak", "SELL", []float64{95, 115}, false, 105},
+		{"falling price to buy", "BUY", []float64{95, 80, 85}, false, 90},
+		{"price rising by the trail amount to buy", "BUY", []float64{80, 90}, true, 90},
+	}
+	for _, test := range tests {
+		triggerPrice := 90.0
+		if test.orderType == "BUY" {
+			triggerPrice = 110.0
+		}
+		stopOrder := &StandingOrder{
+			Type:         test.orderType,
+			State:        "UNTRIGGERED",
+			TriggerPrice: triggerPrice,
+			TrailAmount:  10,
+			CreatedAt:    placedAt,
+		}
+		triggered := followTrades(stopOrder, newTestTrades(1, placedAt, test.prices...))
+		if triggered != test.triggered {
+			t.Errorf("%v: The stop order has been triggered: %v, expected %v.", test.name, triggered, test.triggered)
+		}
+		if stopOrder.TriggerPrice != test.triggerPrice {
+			t.Errorf("%v: The trigger price of the stop order is %v, expected %v.", test.name, stopOrder.TriggerPrice, test.triggerPrice)
+		}
+	}
+}
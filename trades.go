@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// An execution of a part of a standing order (the maker order)
+// against an order of another user (the taker order).
+type Trade struct {
+	// Using signed integers in the models because the underlying database (PostgreSQL) only supports signed integers.
+	ID           int64 `gorm:"primaryKey"`
+	MakerOrderId int64 `json:"maker_order_id" gorm:"not null; index"`
+	// the users are not shown so that they do not learn who they have traded with
+	MakerUserId string `json:"-" gorm:"not null; index"`
+	// ID of the taker's standing order or zero if the taker has used a market order
+	TakerOrderId int64  `json:"taker_order_id" gorm:"not null; index"`
+	TakerUserId  string `json:"-" gorm:"not null; index"`
+	// the type of the taker order, BUY or SELL
+	Side string `gorm:"not null"`
+	// USD cents price for one Satoshi, which is the limit price of the maker order
+	Price float64 `gorm:"not null"`
+	// quantity is represented in Satoshis
+	Quantity       int64 `gorm:"not null"`
+	UsdCentsAmount int64 `json:"usd_cents_amount" gorm:"not null"`
+	// The fees paid by the maker and the taker, in the currency received by each of them:
+	// Satoshis for the buyer and USD cents for the seller.
+	MakerFee  int64     `json:"maker_fee" gorm:"default:0; not null"`
+	TakerFee  int64     `json:"taker_fee" gorm:"default:0; not null"`
+	CreatedAt time.Time `json:"created_at" gorm:"index"`
+}
+
+const DEFAULT_PAGE_SIZE = 100
+const MAX_PAGE_SIZE = 1000
+
+// Record the execution of the provided part of the standing order
+// against the taker's order, together with its ledger entries,
+// within the provided transaction.
+func recordTrade(tx *gorm.DB, standingOrder *StandingOrder, takerUserId string, takerOrderId int64, satoshiAmount int64, usdCentsAmount int64, makerFee int64, takerFee int64) (*Trade, error) {
+	side := "BUY"
+	if standingOrder.Type == "BUY" {
+		side = "SELL"
+	}
+	trade := &Trade{
+		MakerOrderId:   standingOrder.ID,
+		MakerUserId:    standingOrder.UserId,
+		TakerOrderId:   takerOrderId,
+		TakerUserId:    takerUserId,
+		Side:           side,
+		Price:          standingOrder.LimitPrice,
+		Quantity:       satoshiAmount,
+		UsdCentsAmount: usdCentsAmount,
+		MakerFee:       makerFee,
+		TakerFee:       takerFee,
+	}
+	result := tx.Create(trade)
+	if err := result.Error; err != nil {
+		log.Printf("Unable to create trade %v. Error: %v", trade, err)
+		return nil, err
+	}
+	log.Printf("Trade recorded: Type: %T, Value: %v", trade, trade)
+	ORDER_BOOK.AddTrade(trade)
+	buyerId, sellerId := trade.TakerUserId, trade.MakerUserId
+	buyerFee, sellerFee := takerFee, makerFee
+	if side == "SELL" {
+		buyerId, sellerId = sellerId, buyerId
+		buyerFee, sellerFee = sellerFee, buyerFee
+	}
+	entries := append(transferEntries(buyerId, sellerId, "USD", usdCentsAmount), transferEntries(sellerId, buyerId, "BTC", satoshiAmount)...)
+	_, err := postJournal(tx, "TRADE", trade.ID, entries)
+	if err != nil {
+		return nil, err
+	}
+	entries = nil
+	if buyerFee > 0 {
+		entries = append(entries, transferEntries(buyerId, HOUSE_USER_ID, "BTC", buyerFee)...)
+	}
+	if sellerFee > 0 {
+		entries = append(entries, transferEntries(sellerId, HOUSE_USER_ID, "USD", sellerFee)...)
+	}
+	if len(entries) == 0 {
+		return trade, nil
+	}
+	_, err = postJournal(tx, "FEE", trade.ID, entries)
+	if err != nil {
+		return nil, err
+	}
+	return trade, nil
+}
+
+// Get the most recent trade.
+func getLastTrade(tx *gorm.DB) (*Trade, error) {
+	trade := &Trade{}
+	result := tx.Order("id desc").Take(trade)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, NO_PRICE_AVAILABLE
+	}
+	if err := result.Error; err != nil {
+		log.Printf("Unable to get the last trade. Error: %v", err)
+		return nil, err
+	}
+	return trade, nil
+}
+
+// Get the offset and limit of the requested page from the URL query parameters.
+func getPageFromRequest(r *http.Request) (offset int, limit int, err error) {
+	query := r.URL.Query()
+	limit = DEFAULT_PAGE_SIZE
+	if value := query.Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil {
+			log.Printf("Unable to convert provided string to int. Error: %v", err)
+			return 0, 0, err
+		}
+		if limit <= 0 || limit > MAX_PAGE_SIZE {
+			return 0, 0, fmt.Errorf("The limit %v is out of the allowed range from 1 to %v.", limit, MAX_PAGE_SIZE)
+		}
+	}
+	if value := query.Get("offset"); value != "" {
+		offset, err = strconv.Atoi(value)
+		if err != nil {
+			log.Printf("Unable to convert provided string to int. Error: %v", err)
+			return 0, 0, err
+		}
+		if offset < 0 {
+			return 0, 0, fmt.Errorf("The offset %v must not be negative.", offset)
+		}
+	}
+	return offset, limit, nil
+}
+
+// Get the trades in which the user has participated as either maker or taker,
+// starting with the most recent ones.
+func (user *User) GetTrades(offset int, limit int) ([]*Trade, error) {
+	trades := []*Trade{}
+	result := DB.Where("maker_user_id = ? OR taker_user_id = ?", user.ID, user.ID).Order("id desc").Offset(offset).Limit(limit).Find(&trades)
+	if err := result.Error; err != nil {
+		log.Printf("Unable to get trades of user with ID %v. Error: %v", user.ID, err)
+		return nil, err
+	}
+	return trades, nil
+}
+
+func getTradesHandler(user *User, w http.ResponseWriter, r *http.Request) {
+	offset, limit, err := getPageFromRequest(r)
+	if err != nil {
+		log.Printf("Unable to get the requested page. Error: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	trades, err := user.GetTrades(offset, limit)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	output, err := json.Marshal(trades)
+	if err != nil {
+		log.Printf("Unable to serialize Trade objects to JSON. Error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Write(output)
+}
+
+func tradesHandler(w http.ResponseWriter, r *http.Request) {
+	tx := DB.Begin()
+	user := getAuthenticatedUser(tx, r)
+	if user == nil {
+		tx.Rollback()
+		log.Printf("Unable to get authenticated user.")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		// DB transaction with the read operation on user is unnecessary in this case
+		tx.Rollback()
+		getTradesHandler(user, w, r)
+	default:
+		tx.Rollback()
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
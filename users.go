@@ -16,6 +16,9 @@ type User struct {
 	// Using signed integers in the models because the underlying database (PostgreSQL) only supports signed integers.
 	USDCentsBalance   int64 `gorm:"default:0; not null"`
 	BTCSatoshiBalance int64 `gorm:"default:0; not null"`
+	// The secret used to sign the webhook requests about the user's standing orders.
+	// It consists of two random UUIDs, which provide 244 random bits in total.
+	WebhookSecret string `json:"-" gorm:"default:replace(gen_random_uuid()::text || gen_random_uuid()::text, '-', ''); not null"`
 }
 
 func getUserFromDb(tx *gorm.DB, user *User, query_parameters ...interface{}) (bool, error) {
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// A webhook request about a change of a standing order,
+// which is waiting to be delivered or has already been delivered.
+//
+// The events are written to the database in the same transaction
+// as the change of the standing order that they describe
+// and delivered later by the webhook dispatcher.
+type WebhookEvent struct {
+	// Using signed integers in the models because the underlying database (PostgreSQL) only supports signed integers.
+	ID              int64 `gorm:"primaryKey"`
+	StandingOrderId int64 `json:"standing_order_id" gorm:"not null; index"`
+	// the owner of the standing order, whose secret is used to sign the webhook request
+	UserId string
+	URL    string `gorm:"not null"`
+	// ORDER_FILLED, ORDER_CANCELLED, ORDER_AMENDED, ORDER_EXPIRED or ORDER_TRIGGERED
+	EventType string `json:"event_type" gorm:"not null"`
+	// the JSON body of the webhook request
+	Payload string `gorm:"not null"`
+	// PENDING, DELIVERED or DEAD
+	State         string    `gorm:"not null; index:idx_pending"`
+	Attempts      int64     `gorm:"default:0; not null"`
+	NextAttemptAt time.Time `json:"next_attempt_at" gorm:"not null; index:idx_pending"`
+	LastError     string    `json:"last_error"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// The JSON body of a webhook request.
+type WebhookPayload struct {
+	EventType string         `json:"event_type"`
+	Order     *StandingOrder `json:"order"`
+	// all the trades in which the order has participated so far
+	Fills []*Trade `json:"fills"`
+}
+
+const WEBHOOK_POLL_INTERVAL = time.Second
+const WEBHOOK_BATCH_SIZE = 100
+const WEBHOOK_INITIAL_BACKOFF = time.Second
+const WEBHOOK_MAX_BACKOFF = time.Hour
+
+// The number of failed attempts after which the event is moved to the dead-letter state.
+const WEBHOOK_MAX_ATTEMPTS = 10
+
+var WEBHOOK_HTTP_CLIENT = &http.Client{Timeout: 10 * time.Second}
+
+// Get the trades in which the standing order has participated as either maker or taker.
+func (standingOrder *StandingOrder) GetFills(tx *gorm.DB) ([]*Trade, error) {
+	fills := []*Trade{}
+	result := tx.Where("maker_order_id = ? OR taker_order_id = ?", standingOrder.ID, standingOrder.ID).Order("id asc").Find(&fills)
+	if err := result.Error; err != nil {
+		log.Printf("Unable to get fills of standing order with ID %v. Error: %v", standingOrder.ID, err)
+		return nil, err
+	}
+	return fills, nil
+}
+
+// Write the webhook event of the provided type about the current state of the standing order
+// within the provided transaction, if the standing order has a webhook URL.
+func (standingOrder *StandingOrder) EnqueueWebhook(tx *gorm.DB, eventType string) error {
+	if standingOrder.WebhookURL == "" {
+		return nil
+	}
+	fills, err := standingOrder.GetFills(tx)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(WebhookPayload{
+		EventType: eventType,
+		Order:     standingOrder,
+		Fills:     fills,
+	})
+	if err != nil {
+		log.Printf("Unable to serialize WebhookPayload object to JSON. Error: %v", err)
+		return err
+	}
+	event := &WebhookEvent{
+		StandingOrderId: standingOrder.ID,
+		UserId:          standingOrder.UserId,
+		URL:             standingOrder.WebhookURL,
+		EventType:       eventType,
+		Payload:         string(payload),
+		State:           "PENDING",
+		NextAttemptAt:   time.Now(),
+	}
+	result := tx.Create(event)
+	if err := result.Error; err != nil {
+		log.Printf("Unable to create webhook event %v. Error: %v", event, err)
+		return err
+	}
+	log.Printf("Webhook event enqueued: Type: %T, Value: %v", event, event)
+	return nil
+}
+
+// Compute the signature of the webhook request with the provided payload
+// sent at the provided Unix timestamp, using the provided secret.
+// The signature is the hex-encoded HMAC-SHA256 of the timestamp and the payload joined by a dot.
+func signWebhookPayload(secret string, timestamp int64, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%v.%v", timestamp, payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Deliver the webhook event to its URL, signed with the provided secret.
+func (event *WebhookEvent) PerformWebhookRequest(secret string) error {
+	log.Printf("Performing a webhook request %v for standing order %v to URL %v.", event.ID, event.StandingOrderId, event.URL)
+	request, err := http.NewRequest("POST", event.URL, bytes.NewBufferString(event.Payload))
+	if err != nil {
+		log.Printf("Unable to create the webhook request %v. Error: %v", event.ID, err)
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	// allows the receivers to recognize the repeated deliveries of the same event
+	request.Header.Set("X-Webhook-Event-Id", fmt.Sprint(event.ID))
+	// The timestamp is a part of the signature
+	// so that the receivers can reject the replayed requests.
+	timestamp := time.Now().Unix()
+	request.Header.Set("X-Webhook-Timestamp", fmt.Sprint(timestamp))
+	request.Header.Set("X-Webhook-Signature", "v1="+signWebhookPayload(secret, timestamp, event.Payload))
+	response, err := WEBHOOK_HTTP_CLIENT.Do(request)
+	if err != nil {
+		log.Printf("Unable to perform the webhook request %v. Error: %v", event.ID, err)
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("The webhook request %v has been answered with status %v.", event.ID, response.Status)
+	}
+	return nil
+}
+
+// Get the time to wait before the next attempt to deliver an event
+// which has already failed the provided number of times.
+func getWebhookBackoff(attempts int64) time.Duration {
+	backoff := WEBHOOK_INITIAL_BACKOFF
+	for i := int64(1); i < attempts && backoff < WEBHOOK_MAX_BACKOFF; i++ {
+		backoff *= 2
+	}
+	if backoff > WEBHOOK_MAX_BACKOFF {
+		backoff = WEBHOOK_MAX_BACKOFF
+	}
+	return backoff
+}
+
+// Try to deliver the pending webhook events whose next attempt is due.
+func dispatchWebhooks() error {
+	var events []*WebhookEvent
+	result := DB.Where(&WebhookEvent{State: "PENDING"}).Where("next_attempt_at <= ?", time.Now()).Order("id asc").Limit(WEBHOOK_BATCH_SIZE).Find(&events)
+	if err := result.Error; err != nil {
+		log.Printf("Unable to get the pending webhook events. Error: %v", err)
+		return err
+	}
+	for _, event := range events {
+		// the secret is read at the time of the delivery so that the rotated secrets take effect immediately
+		user := &User{ID: event.UserId}
+		found, err := getUserFromDb(DB, user)
+		ownerMissing := err == nil && !found
+		if ownerMissing {
+			// the request cannot be signed and retrying would not help
+			log.Printf("Giving up on webhook event %v because its owner with ID %v does not exist.", event.ID, event.UserId)
+			err = fmt.Errorf("The owner with ID %v of the webhook event %v does not exist.", event.UserId, event.ID)
+		}
+		if err == nil {
+			err = event.PerformWebhookRequest(user.WebhookSecret)
+		}
+		event.Attempts++
+		if err == nil {
+			event.State = "DELIVERED"
+			event.LastError = ""
+		} else {
+			event.LastError = err.Error()
+			if ownerMissing {
+				event.State = "DEAD"
+			} else if event.Attempts >= WEBHOOK_MAX_ATTEMPTS {
+				log.Printf("Giving up on webhook event %v after %v attempts.", event.ID, event.Attempts)
+				event.State = "DEAD"
+			} else {
+				event.NextAttemptAt = time.Now().Add(getWebhookBackoff(event.Attempts))
+			}
+		}
+		result := DB.Save(event)
+		if err := result.Error; err != nil {
+			log.Printf("Unable to save webhook event %v. Error: %v", event, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// Keep delivering the pending webhook events in the background.
+func startWebhookDispatcher() {
+	log.Printf("Starting the webhook dispatcher.")
+	go func() {
+		for {
+			dispatchWebhooks()
+			time.Sleep(WEBHOOK_POLL_INTERVAL)
+		}
+	}()
+}
+
+// The webhook signing secret of a user.
+type WebhookSecret struct {
+	WebhookSecret string `json:"webhook_secret"`
+}
+
+// Replace the user's webhook signing secret with a new random one.
+func (user *User) RotateWebhookSecret(tx *gorm.DB) error {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		log.Printf("Unable to generate a random webhook secret. Error: %v", err)
+		return err
+	}
+	user.WebhookSecret = hex.EncodeToString(secret)
+	result := tx.Model(user).Update("webhook_secret", user.WebhookSecret)
+	if err := result.Error; err != nil {
+		log.Printf("Unable to save the webhook secret of user with ID %v. Error: %v", user.ID, err)
+		return err
+	}
+	return nil
+}
+
+func writeWebhookSecret(user *User, w http.ResponseWriter) {
+	output, err := json.Marshal(WebhookSecret{WebhookSecret: user.WebhookSecret})
+	if err != nil {
+		log.Printf("Unable to serialize WebhookSecret object to JSON. Error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Write(output)
+}
+
+func postWebhookSecretHandler(tx *gorm.DB, user *User, w http.ResponseWriter, r *http.Request) {
+	err := user.RotateWebhookSecret(tx)
+	if err != nil {
+		tx.Rollback()
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	result := tx.Commit()
+	if err := result.Error; err != nil {
+		tx.Rollback()
+		log.Printf("Unable to commit the transaction. Error: %v", result.Error)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Webhook secret of user with ID %v has been rotated.", user.ID)
+	writeWebhookSecret(user, w)
+}
+
+func webhookSecretHandler(w http.ResponseWriter, r *http.Request) {
+	tx := DB.Begin()
+	user := getAuthenticatedUser(tx, r)
+	if user == nil {
+		tx.Rollback()
+		log.Printf("Unable to get authenticated user.")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		// DB transaction with the read operation on user is unnecessary in this case
+		tx.Rollback()
+		writeWebhookSecret(user, w)
+	case "POST":
+		// the POST handler commits or rolls back the transaction as necessary
+		postWebhookSecretHandler(tx, user, w, r)
+	default:
+		tx.Rollback()
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
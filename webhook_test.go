@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGetWebhookBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int64
+		backoff  time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{10, 512 * time.Second},
+		{12, 2048 * time.Second},
+		// capped at the maximum backoff
+		{13, time.Hour},
+		{100, time.Hour},
+	}
+	for _, test := range tests {
+		backoff := getWebhookBackoff(test.attempts)
+		if backoff != test.backoff {
+			t.Errorf("The backoff after %v attempts is %v, expected %v.", test.attempts, backoff, test.backoff)
+		}
+	}
+}
+
+func TestSignWebhookPayload(t *testing.T) {
+	payload := `{"event":"ORDER_FILLED"}`
+	tests := []struct {
+		secret    string
+		timestamp int64
+		signature string
+	}{
+		{"secret", 1700000000, "422044ad447e02184dfba4b2296a0f43c4bcf3bbf33e3f81159a3c61e6495c09"},
+		{"other", 1700000000, "0211f99bafc2d2ae1c0271ef1ce9e702c3fda29a1598f2330164779ff1654d3d"},
+		// the timestamp is a part of the signature
+		{"secret", 1700000001, "edae4a7ce233c54ceed58d5c227bef7fb3667a6e45a81e5f86f9c99119177651"},
+	}
+	for _, test := range tests {
+		signature := signWebhookPayload(test.secret, test.timestamp, payload)
+		if signature != test.signature {
+			t.Errorf("The signature with secret %v at %v is %v, expected %v.", test.secret, test.timestamp, signature, test.signature)
+		}
+	}
+}
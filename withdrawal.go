@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// A withdrawal of BTC or USD from the user's balance to the outside of the exchange.
+type Withdrawal struct {
+	// Using signed integers in the models because the underlying database (PostgreSQL) only supports signed integers.
+	ID       int64  `gorm:"primaryKey"`
+	UserId   string `gorm:"not null; index"`
+	Currency string `gorm:"not null"`
+	// amount is represented in USD cents or Satoshis, depending on the currency
+	Amount int64 `gorm:"not null"`
+	// REQUESTED, COMPLETED or FAILED
+	State string `gorm:"not null"`
+	// the reason why the withdrawal has failed, if it has
+	FailureReason string    `json:"failure_reason"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// A new withdrawal of BTC or USD.
+type NewWithdrawal struct {
+	// amount in BTC or USD, depending on the currency
+	Amount   float64
+	Currency string
+}
+
+func getWithdrawalFromDb(tx *gorm.DB, id int64) (*Withdrawal, error) {
+	withdrawal := &Withdrawal{}
+	result := tx.Where(&Withdrawal{ID: id}, "ID").Take(withdrawal)
+	if err := result.Error; err != nil {
+		log.Printf("Unable to find withdrawal with ID %v. Error: %v", id, err)
+		return nil, err
+	}
+	log.Printf("Withdrawal found: Type: %T, Value: %v", withdrawal, withdrawal)
+	return withdrawal, nil
+}
+
+// Get the amount of the currency that the user has available,
+// i.e. the balance which is not blocked by the user's live standing orders.
+func (user *User) GetAvailableAmount(tx *gorm.DB, currency string) (int64, error) {
+	if currency == "USD" {
+		blockedUsdCentsAmount, err := user.GetBlockedUsdCents(tx)
+		if err != nil {
+			return 0, err
+		}
+		return user.USDCentsBalance - blockedUsdCentsAmount, nil
+	}
+	// currency == "BTC"
+	blockedSatoshiAmount, err := user.GetBlockedSatoshis(tx)
+	if err != nil {
+		return 0, err
+	}
+	return user.BTCSatoshiBalance - blockedSatoshiAmount, nil
+}
+
+// Create the user's withdrawal in the requested state
+// and commit the provided transaction.
+func (user *User) RequestWithdrawal(tx *gorm.DB, newWithdrawal *NewWithdrawal) (*Withdrawal, error) {
+	withdrawal := &Withdrawal{
+		UserId:   user.ID,
+		Currency: newWithdrawal.Currency,
+		State:    "REQUESTED",
+	}
+	if newWithdrawal.Currency == "USD" {
+		withdrawal.Amount = int64(newWithdrawal.Amount * 100)
+	} else { // newWithdrawal.Currency == "BTC"
+		withdrawal.Amount = int64(newWithdrawal.Amount * 100000000)
+	}
+	result := tx.Create(withdrawal)
+	if err := result.Error; err != nil {
+		tx.Rollback()
+		log.Printf("Unable to create withdrawal %v. Error: %v", withdrawal, err)
+		return nil, err
+	}
+	result = tx.Commit()
+	if err := result.Error; err != nil {
+		tx.Rollback()
+		log.Printf("Unable to commit the transaction. Error: %v", result.Error)
+		return nil, err
+	}
+	return withdrawal, nil
+}
+
+// Mark the provided requested withdrawal as failed for the provided reason.
+func (withdrawal *Withdrawal) Fail(tx *gorm.DB, reason string) error {
+	withdrawal.State = "FAILED"
+	withdrawal.FailureReason = reason
+	result := tx.Save(withdrawal)
+	if err := result.Error; err != nil {
+		log.Printf("Unable to save the withdrawal %v. Error: %v", withdrawal, err)
+		return err
+	}
+	return nil
+}
+
+// Take the amount of the provided requested withdrawal from the user's balance, if it is available.
+// Otherwise, mark the withdrawal as failed.
+func (user *User) CompleteWithdrawal(withdrawal *Withdrawal) error {
+	// The order book session serializes the withdrawal with the standing orders which block the balance.
+	// It needs to start before the transaction so that the transaction sees the changes made by the previous sessions.
+	ORDER_BOOK.Begin()
+	tx := DB.Begin()
+	// the user's balance might have changed since it has been read from the database
+	_, err := getUserFromDb(tx, user)
+	if err != nil {
+		tx.Rollback()
+		ORDER_BOOK.Rollback()
+		return err
+	}
+	availableAmount, err := user.GetAvailableAmount(tx, withdrawal.Currency)
+	if err != nil {
+		tx.Rollback()
+		ORDER_BOOK.Rollback()
+		log.Printf("Unable to determine the available %v amount of user with ID %v. Error: %v", withdrawal.Currency, user.ID, err)
+		return err
+	}
+	if withdrawal.Amount > availableAmount {
+		reason := fmt.Sprintf("Insufficient balance: The available amount is %v but the requested amount is %v.", formatAmount(withdrawal.Currency, availableAmount), formatAmount(withdrawal.Currency, withdrawal.Amount))
+		log.Printf("Withdrawal %v of user with ID %v has failed. Reason: %v", withdrawal.ID, user.ID, reason)
+		err = withdrawal.Fail(tx, reason)
+		if err != nil {
+			tx.Rollback()
+			ORDER_BOOK.Rollback()
+			return err
+		}
+		result := tx.Commit()
+		if err := result.Error; err != nil {
+			tx.Rollback()
+			ORDER_BOOK.Rollback()
+			log.Printf("Unable to commit the transaction. Error: %v", result.Error)
+			return err
+		}
+		ORDER_BOOK.Commit()
+		return INSUFFICIENT_BALANCE
+	}
+	if withdrawal.Currency == "USD" {
+		user.USDCentsBalance -= withdrawal.Amount
+	} else { // withdrawal.Currency == "BTC"
+		user.BTCSatoshiBalance -= withdrawal.Amount
+	}
+	_, err = postJournal(tx, "WITHDRAWAL", 0, transferEntries(user.ID, EXTERNAL_ACCOUNT, withdrawal.Currency, withdrawal.Amount))
+	if err != nil {
+		tx.Rollback()
+		ORDER_BOOK.Rollback()
+		log.Printf("Unable to record the withdrawal %v in the ledger. Error: %v", withdrawal, err)
+		return err
+	}
+	result := tx.Save(user)
+	if err := result.Error; err != nil {
+		tx.Rollback()
+		ORDER_BOOK.Rollback()
+		log.Printf("Unable to save user %v. Error: %v", user, err)
+		return err
+	}
+	withdrawal.State = "COMPLETED"
+	result = tx.Save(withdrawal)
+	if err := result.Error; err != nil {
+		tx.Rollback()
+		ORDER_BOOK.Rollback()
+		log.Printf("Unable to save the withdrawal %v. Error: %v", withdrawal, err)
+		return err
+	}
+	result = tx.Commit()
+	if err := result.Error; err != nil {
+		tx.Rollback()
+		ORDER_BOOK.Rollback()
+		log.Printf("Unable to commit the transaction. Error: %v", result.Error)
+		return err
+	}
+	ORDER_BOOK.Commit()
+	log.Printf("Withdrawal %v of user with ID %v has been completed.", withdrawal.ID, user.ID)
+	return nil
+}
+
+// Format the provided amount in USD cents or Satoshis in the units of the currency.
+func formatAmount(currency string, amount int64) string {
+	if currency == "USD" {
+		return fmt.Sprintf("%v USD", float64(amount)/100)
+	}
+	return fmt.Sprintf("%v BTC", float64(amount)/100000000)
+}
+
+// Get the user's withdrawal with the provided ID.
+func (user *User) GetWithdrawal(id int64) (*Withdrawal, error) {
+	withdrawal, err := getWithdrawalFromDb(DB, id)
+	if err != nil {
+		return nil, err
+	}
+	if withdrawal.UserId != user.ID {
+		return nil, PERMISSION_DENIED
+	}
+	return withdrawal, nil
+}
+
+func getWithdrawalId(r *http.Request) (int64, error) {
+	escapedUrlPath := html.EscapeString(r.URL.Path)
+	match := URL_PATH_PARTS.FindStringSubmatch(escapedUrlPath)
+	if match == nil || match[2] == "" {
+		return 0, errors.New("No withdrawal ID to show. Ignoring.")
+	}
+	value, err := strconv.ParseInt(match[2], 10, 64)
+	if err != nil {
+		log.Printf("Unable to convert provided string to int64. Error: %v", err)
+		return 0, err
+	}
+	return value, nil
+}
+
+func writeWithdrawal(withdrawal *Withdrawal, w http.ResponseWriter) {
+	output, err := json.Marshal(withdrawal)
+	if err != nil {
+		log.Printf("Unable to serialize Withdrawal object to JSON. Error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Write(output)
+}
+
+func getWithdrawalHandler(user *User, w http.ResponseWriter, r *http.Request) {
+	withdrawalId, err := getWithdrawalId(r)
+	if err != nil {
+		log.Printf("Unable to get withdrawal ID. Error: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	withdrawal, err := user.GetWithdrawal(withdrawalId)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		log.Printf("Withdrawal with ID %v not found.", withdrawalId)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, PERMISSION_DENIED) {
+		log.Printf("No permission to get withdrawal with ID %v.", withdrawalId)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		log.Printf("Unable to get withdrawal %v. Error: %v", withdrawalId, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeWithdrawal(withdrawal, w)
+}
+
+func postWithdrawalHandler(tx *gorm.DB, user *User, w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	newWithdrawal := NewWithdrawal{}
+	err := decoder.Decode(&newWithdrawal)
+	if err != nil {
+		tx.Rollback()
+		log.Printf("Unable to decode request body from JSON. Error: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	log.Printf("Withdrawal request for user %v: %v", user.ID, newWithdrawal)
+	if newWithdrawal.Currency != "BTC" && newWithdrawal.Currency != "USD" {
+		tx.Rollback()
+		log.Printf("Unknown currency %v has been provided.", newWithdrawal.Currency)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if newWithdrawal.Amount <= 0 {
+		tx.Rollback()
+		log.Printf("Non-positive amount %v has been provided.", newWithdrawal.Amount)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	// the RequestWithdrawal method commits or rolls back the transaction as necessary
+	withdrawal, err := user.RequestWithdrawal(tx, &newWithdrawal)
+	// transaction is no longer in progress here
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	err = user.CompleteWithdrawal(withdrawal)
+	if errors.Is(err, INSUFFICIENT_BALANCE) {
+		w.WriteHeader(http.StatusConflict)
+		// the output will still contain the failed withdrawal with the reason of its failure
+		writeWithdrawal(withdrawal, w)
+		return
+	}
+	if err != nil {
+		log.Printf("Unable to complete withdrawal %v. Error: %v", withdrawal, err)
+		// the balance has not been changed because the transaction has been rolled back
+		withdrawal.Fail(DB, "Internal error.")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeWithdrawal(withdrawal, w)
+}
+
+func withdrawalHandler(w http.ResponseWriter, r *http.Request) {
+	tx := DB.Begin()
+	user := getAuthenticatedUser(tx, r)
+	if user == nil {
+		tx.Rollback()
+		log.Printf("Unable to get authenticated user.")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		// DB transaction with the read operation on user is unnecessary in this case
+		tx.Rollback()
+		getWithdrawalHandler(user, w, r)
+	case "POST":
+		// the POST handler commits or rolls back the transaction as necessary
+		postWithdrawalHandler(tx, user, w, r)
+	default:
+		tx.Rollback()
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}